@@ -0,0 +1,190 @@
+package atomkv
+
+import (
+	"sort"
+)
+
+// Batch collects sets and deletes to apply atomically with Commit. Build
+// one with NewBatch; the methods chain:
+//
+//	err := db.NewBatch().Set("a", "1").Delete("b").Commit()
+//
+// A Batch is not safe for concurrent use.
+type Batch struct {
+	b   *Bitcask
+	ops []batchOp
+}
+
+// batchOp is one queued write; a delete when deleted is set.
+type batchOp struct {
+	key     string
+	value   string
+	deleted bool
+}
+
+// NewBatch returns an empty batch for the database.
+func (b *Bitcask) NewBatch() *Batch {
+	return &Batch{b: b}
+}
+
+// Set queues a write of key.
+func (wb *Batch) Set(key, value string) *Batch {
+	wb.ops = append(wb.ops, batchOp{key: key, value: value})
+	return wb
+}
+
+// Delete queues a delete of key. Deleting a key that does not exist when
+// the batch commits is not an error; it is skipped.
+func (wb *Batch) Delete(key string) *Batch {
+	wb.ops = append(wb.ops, batchOp{key: key, deleted: true})
+	return wb
+}
+
+// Len returns the number of queued operations.
+func (wb *Batch) Len() int {
+	return len(wb.ops)
+}
+
+// Reset discards the queued operations, keeping the allocated space so
+// the batch can be refilled cheaply.
+func (wb *Batch) Reset() {
+	clear(wb.ops)
+	wb.ops = wb.ops[:0]
+}
+
+// Commit applies the queued operations in order. All records are appended
+// with a single write before the index changes, so either every operation
+// takes effect or, if the write fails, none does. On success the batch is
+// reset for reuse; on failure it keeps its operations.
+func (wb *Batch) Commit() error {
+	b := wb.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.commitBatch(wb.ops); err != nil {
+		return err
+	}
+	wb.Reset()
+	return nil
+}
+
+// WriteBatch stores every pair in pairs atomically: the records are
+// appended with a single write, and the index is only updated once it
+// succeeds. It is shorthand for a Batch of sets, applied in key order.
+func (b *Bitcask) WriteBatch(pairs map[string]string) error {
+	keys := make([]string, 0, len(pairs))
+	for k := range pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ops := make([]batchOp, len(keys))
+	for i, k := range keys {
+		ops[i] = batchOp{key: k, value: pairs[k]}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.commitBatch(ops)
+}
+
+// commitBatch appends ops as one write and then applies them to the index.
+// The caller holds the write lock.
+func (b *Bitcask) commitBatch(ops []batchOp) error {
+	if b.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	// Work out which operations change anything, tracking keys the
+	// batch itself creates and removes.
+	exists := make(map[string]bool)
+	live := func(key string) bool {
+		if v, ok := exists[key]; ok {
+			return v
+		}
+		return b.exists(key)
+	}
+	var apply []batchOp
+	keys := len(b.index)
+	for _, op := range ops {
+		if !op.deleted {
+			if err := b.checkSize(op.key, len(op.value), len(op.value)); err != nil {
+				return err
+			}
+		}
+		was := live(op.key)
+		if op.deleted && !was {
+			continue
+		}
+		if op.deleted {
+			keys--
+		} else if !was {
+			keys++
+		}
+		exists[op.key] = !op.deleted
+		apply = append(apply, op)
+	}
+	if len(apply) == 0 {
+		return nil
+	}
+	if b.opts.MaxKeys > 0 && keys > b.opts.MaxKeys && keys > len(b.index) {
+		return ErrMaxKeysReached
+	}
+	if err := b.checkDiskSpace(); err != nil {
+		return err
+	}
+
+	timestamp := b.nextTimestamp()
+	var buf []byte
+	starts := make([]int64, len(apply))
+	stored := make([][]byte, len(apply))
+	flags := make([]uint8, len(apply))
+	for i, op := range apply {
+		stored[i], flags[i] = []byte(op.value), uint8(typeString)
+		if !op.deleted {
+			var err error
+			if stored[i], flags[i], err = b.storedPayload(op.key, stored[i], flags[i]); err != nil {
+				return err
+			}
+		}
+		starts[i] = int64(len(buf))
+		buf = b.format.encodeRecord(buf, timestamp, 0, flags[i], op.key, stored[i], op.deleted)
+	}
+
+	if err := b.sealIfFull(); err != nil {
+		return err
+	}
+	offset := b.end
+	if err := b.appendRecord(buf); err != nil {
+		return err
+	}
+	if b.opts.SyncOnWrite {
+		if err := b.syncFile(); err != nil {
+			return err
+		}
+	}
+
+	ts := b.timeOf(timestamp)
+	for i, op := range apply {
+		b.records++
+		if op.deleted {
+			b.deletes.Add(1)
+			b.dead += b.format.recordSize(len(op.key), tombstone)
+			b.indexDelete(op.key)
+			b.publish(Event{Key: op.key, Deleted: true, Timestamp: ts})
+			continue
+		}
+		b.indexPut(op.key, entry{
+			offset:     offset + starts[i],
+			valueSize:  uint32(len(stored[i])),
+			timestamp:  timestamp,
+			compressed: flags[i]&flagCompressed != 0,
+			encrypted:  flags[i]&flagEncrypted != 0,
+		})
+		b.cacheValue(op.key, []byte(op.value))
+		b.sets.Add(1)
+		b.publish(Event{Key: op.key, Value: op.value, Timestamp: ts})
+	}
+	b.maybeCompact()
+	return nil
+}
@@ -0,0 +1,127 @@
+package atomkv
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestBatchMixedSetDelete(t *testing.T) {
+	db, path := openTestDB(t, Options{})
+	if err := db.Set("x", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	wb := db.NewBatch()
+	err := wb.Set("a", "1").
+		Set("b", "2").
+		Delete("x").
+		Delete("missing").
+		Set("c", "3").
+		Delete("c").
+		Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := wb.Len(); n != 0 {
+		t.Fatalf("Len() after Commit = %d; want 0", n)
+	}
+
+	check := func(db *Bitcask) {
+		t.Helper()
+		want := map[string]string{"a": "1", "b": "2"}
+		got, err := db.GetMulti([]string{"a", "b", "c", "x"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("values = %v; want %v", got, want)
+		}
+	}
+	check(db)
+
+	// The committed batch is reusable.
+	if err := wb.Set("b", "2").Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if err := reopened.Load(); err != nil {
+		t.Fatal(err)
+	}
+	check(reopened)
+}
+
+func TestBatchRejectedAppliesNothing(t *testing.T) {
+	db, _ := openTestDB(t, Options{MaxKeys: 2})
+	if err := db.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	size := db.LogSize()
+
+	wb := db.NewBatch().Delete("a").Set("b", "2").Set("c", "3").Set("d", "4")
+	if err := wb.Commit(); !errors.Is(err, ErrMaxKeysReached) {
+		t.Fatalf("Commit = %v; want ErrMaxKeysReached", err)
+	}
+	if n := wb.Len(); n != 4 {
+		t.Fatalf("failed batch kept %d operations; want 4", n)
+	}
+	if v, err := db.Get("a"); err != nil || v != "1" {
+		t.Fatalf("Get(a) = %q, %v; want the value from before the batch", v, err)
+	}
+	if db.Exists("b") {
+		t.Fatal("key b from the rejected batch exists")
+	}
+	if got := db.LogSize(); got != size {
+		t.Fatalf("log grew from %d to %d bytes", size, got)
+	}
+}
+
+func TestBatchAtomicForReaders(t *testing.T) {
+	db, _ := openTestDB(t, Options{})
+	if err := db.Set("a", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each batch moves a value from a to b or back; a reader must never
+	// see both keys or neither.
+	done := make(chan error, 1)
+	go func() {
+		wb := db.NewBatch()
+		for i := 1; i <= 500; i++ {
+			from, to := "a", "b"
+			if i%2 == 0 {
+				from, to = to, from
+			}
+			if err := wb.Delete(from).Set(to, fmt.Sprint(i)).Commit(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		default:
+		}
+		values, err := db.GetMulti([]string{"a", "b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 1 {
+			t.Fatalf("reader saw a partial batch: %v", values)
+		}
+	}
+}
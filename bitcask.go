@@ -1,214 +1,2208 @@
 package atomkv
 
 import (
+	"bufio"
 	"bytes"
+	"container/heap"
+	"context"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var ErrKeyNotFound = errors.New("key not found")
+var (
+	ErrKeyNotFound          = errors.New("key not found")
+	ErrCompactionInProgress = errors.New("compaction already in progress")
+	ErrMaxKeysReached       = errors.New("maximum number of keys reached")
+	ErrReadOnly             = errors.New("database is read-only")
+	ErrDiskFull             = errors.New("not enough free disk space")
+	ErrNotReadOnly          = errors.New("database is not read-only")
+	ErrCorruptRecord        = errors.New("corrupt record")
+	ErrValueTooLarge        = errors.New("value exceeds maximum size")
+	ErrKeyTooLarge          = errors.New("key exceeds maximum size")
+)
+
+const (
+	defaultCompactBufferSize = 32 * 1024
+	defaultSlowSyncThreshold = time.Second
+	defaultWatchBufferSize   = 64
+	defaultFileMode          = 0644
+
+	// compactOnCloseMinReclaim is the least reclaimable space that makes
+	// CompactOnClose worth the extra work in Close.
+	compactOnCloseMinReclaim = 64 * 1024
+
+	// autoCompactMinDead is the least dead space that lets
+	// AutoCompactThreshold start a compaction, so small databases are
+	// not rewritten over a few stale records.
+	autoCompactMinDead = 64 * 1024
+
+	// diskCheckInterval is how many writes reuse a successful
+	// MinFreeDiskBytes check.
+	diskCheckInterval = 100
+
+	defaultExpireSampleSize = 20
+)
+
+// headerSize is the size of a record header without its checksum:
+// timestamp(8) + keySize(4) + valueSize(4). See record.go for the layout.
+const headerSize = 16
+
+// tombstone is the valueSize of a record that deletes its key. Tombstones
+// carry no value bytes.
+const tombstone = ^uint32(0)
+
+// maxKeySize and maxValueSize are the largest key and stored value a
+// record's uint32 size fields can describe; the all-ones value size marks
+// a tombstone.
+const (
+	maxKeySize   = math.MaxUint32
+	maxValueSize = uint64(tombstone - 1)
+)
+
+// Options configures a Bitcask database. The zero value is valid and
+// matches the behaviour of Open.
+type Options struct {
+	// CompactBufferSize is the size of the buffer used to copy values
+	// into the new file during compaction. Peak compaction memory stays
+	// at this size no matter how large individual values are.
+	// Zero means 32KB.
+	CompactBufferSize int
+
+	// CompactSorted makes Compact write records in ascending key order.
+	// Compacting the same logical data twice then yields byte-identical
+	// files, which helps backup deduplication and golden-file tests.
+	CompactSorted bool
+
+	// CompactDedupValues makes Compact store each distinct value once.
+	// A key whose value is identical to one already copied gets a small
+	// record referring to that copy instead. Reading a shared value costs
+	// a second read, and Stats, IndexReport and RecordInfo report the
+	// reference's size for such keys; a later Set writes a full record as
+	// usual. Values of 16 bytes or less, or larger than CompactBufferSize,
+	// are always copied. Worthwhile only when many keys hold the same
+	// values.
+	CompactDedupValues bool
+
+	// Retry controls how failed file I/O in Get and Set is retried. The
+	// zero value disables retries.
+	Retry RetryPolicy
+
+	// Logger receives diagnostic messages such as retries. Nil discards
+	// them, except warnings that data was dropped, which then go to the
+	// standard logger.
+	Logger Logger
+
+	// CreateDirs creates the parent directory of the database file
+	// (mode 0755) if it does not exist yet.
+	CreateDirs bool
+
+	// FileMode is the permission of the data file when it is created,
+	// before the umask. Compaction keeps it for the new file. Zero means
+	// 0644.
+	FileMode os.FileMode
+
+	// MaxValueSize, if positive, is the largest value in bytes that a
+	// write accepts; larger ones fail with ErrValueTooLarge.
+	MaxValueSize int
+
+	// MaxSegmentSize, if positive, splits the data file into segments of
+	// about this size: once the file reaches it, the next write seals it
+	// as an immutable segment and starts a new file. Compact merges all
+	// segments back into one file. LogSize, Changes and Rotate only cover
+	// the newest file, and sealing increments Generation.
+	MaxSegmentSize int64
+
+	// LoadConcurrency, if greater than one, makes Load scan up to this
+	// many sealed segments at once, each into an index of its own, then
+	// merge those in segment order so the newest record of each key wins.
+	// It shortens loading a database with many segments on a machine with
+	// several cores, at the cost of holding the per-segment indexes in
+	// memory until the merge.
+	LoadConcurrency int
+
+	// SyncOnWrite fsyncs the data file after every Set, so a write that
+	// returned nil survives a crash. It costs one fsync per write.
+	SyncOnWrite bool
+
+	// SyncInterval, if positive, fsyncs the data file from a background
+	// goroutine this often whenever there are unsynced writes. A crash
+	// then loses at most about one interval of acknowledged writes, at a
+	// fraction of the cost of SyncOnWrite.
+	SyncInterval time.Duration
+
+	// WriteBufferSize, if positive, collects appended records in memory
+	// and writes them to the file together once this many bytes are
+	// waiting, so bursts of small writes cost one syscall. Gets of
+	// buffered records are served from memory. Flush, Sync, SyncInterval,
+	// SyncOnWrite and Close write the buffer out, as does anything that
+	// reads the whole file. Buffered writes are lost if the process
+	// crashes, not only if the machine does.
+	WriteBufferSize int
+
+	// HintOnClose makes Close write a hint file recording the index, so
+	// the next Load reads it instead of scanning the data file. Compact
+	// always writes one; see WriteHintFile.
+	HintOnClose bool
+
+	// SnapshotInterval, if positive, rewrites the hint file from a
+	// background goroutine this often once Load has run, whenever the data
+	// file changed since the last one. A process that crashes while idle
+	// then restarts from the hint instead of scanning. A hint only applies
+	// to the exact data size it records, so after a crash that followed
+	// later writes Load scans as usual.
+	SnapshotInterval time.Duration
+
+	// SkipSyncOnClose stops Close from fsyncing the data file. By default
+	// Close syncs so that data written before a clean shutdown survives a
+	// power loss shortly after; skip it only if that does not matter.
+	SkipSyncOnClose bool
+
+	// OnSlowSync, if set, is called with the duration of any fsync that
+	// takes longer than SlowSyncThreshold (default 1s). Slow syncs usually
+	// point at a degrading disk. It runs with the database lock held, so it
+	// must not call back into the Bitcask.
+	OnSlowSync        func(d time.Duration)
+	SlowSyncThreshold time.Duration
+
+	// WatchBufferSize is the number of undelivered events each watch
+	// subscription holds before the oldest is dropped. Zero means 64.
+	WatchBufferSize int
+
+	// CompactOnClose compacts the data file in Close when at least 64KB
+	// can be reclaimed, leaving a minimal file between runs. It can make
+	// Close slow on large databases.
+	CompactOnClose bool
+
+	// AutoCompactThreshold, if positive, starts a compaction in the
+	// background once stale records make up at least this fraction of
+	// the data on disk (see DeadBytes), for example 0.5. Writes wait
+	// while it runs, as with Compact. Nothing happens until at least 64KB
+	// is stale.
+	AutoCompactThreshold float64
+
+	// OnCompactProgress, if set, receives progress reports from
+	// CompactAsync, which runs in the background. It is called without
+	// the database lock held.
+	OnCompactProgress func(CompactProgress)
+
+	// MaxKeys caps the number of distinct keys. A Set that would add a new
+	// key beyond the cap fails with ErrMaxKeysReached; overwriting an
+	// existing key is always allowed. Zero means no limit.
+	MaxKeys int
+
+	// ReadOnly opens an existing database without write access. Writes
+	// and compaction fail with ErrReadOnly, making it safe for tools that
+	// only inspect a database.
+	ReadOnly bool
+
+	// RepairOnLoad lets Load recover from a torn last record, one a crash
+	// left incomplete or failing its checksum: the records before it are
+	// indexed and a writable handle truncates the file there, logging how
+	// many bytes were dropped. A read-only handle leaves the file alone,
+	// which also lets it load while a writer is partway through an append.
+	// Without it Load fails with an error wrapping the cause and the file
+	// is left for inspection.
+	RepairOnLoad bool
+
+	// TimestampMode selects the precision of record timestamps for newly
+	// created files. Existing files keep the mode recorded in their
+	// header. The default is nanoseconds.
+	TimestampMode TimestampMode
+
+	// MinFreeDiskBytes makes writes fail with ErrDiskFull while the
+	// filesystem holding the database has less free space than this,
+	// rather than risking a partially written record. To keep statfs off
+	// the hot path the result is reused for 100 writes while space is
+	// sufficient. Zero disables the check. Only supported on Linux and
+	// macOS; elsewhere it is ignored.
+	MinFreeDiskBytes uint64
+
+	// ChecksumType selects the algorithm that checksums each record in
+	// newly created files; reads verify it and fail with ErrCorruptRecord
+	// on a mismatch. Existing files keep the algorithm recorded in their
+	// header. The default is CRC-32C.
+	ChecksumType ChecksumType
+
+	// Compression compresses values, metadata included, before Set and
+	// batches write them, and Get decompresses them transparently. Each
+	// record notes whether and how it was compressed, so the setting can
+	// change between opens and older records still read. Values under 64
+	// bytes, and values that would not shrink, are stored as they are.
+	// Files in formats older than version 4 are never compressed.
+	Compression Compression
+
+	// EncryptionKey, if set, encrypts values and their metadata with
+	// AES-GCM before they are written, after any compression, and Get
+	// decrypts them. It must be 16, 24 or 32 bytes long (AES-128, -192 or
+	// -256). Keys are not encrypted, since the index needs them. Reading
+	// an encrypted value with a different key, or none, fails with
+	// ErrDecryption. Records written without a key stay readable, and
+	// compaction rewrites records as they are rather than encrypting
+	// them. Files in formats older than version 4 are never encrypted.
+	EncryptionKey []byte
+
+	// PreloadValues makes Load read every value into memory as well, so
+	// Get is served without touching the file. Writes update the copy in
+	// memory as well as the log, which stays the source of truth on
+	// restart. Memory use grows by roughly the total size of the live
+	// values, so this suits small, hot datasets such as configuration.
+	PreloadValues bool
+
+	// VerifyReads changes what Get does when the record at the indexed
+	// offset belongs to another key, meaning the index disagrees with the
+	// file (a bug, or the file was modified behind the database's back).
+	// Normally Get fails with an error wrapping ErrCorruptRecord; with
+	// VerifyReads it logs the discrepancy and scans the whole log for the
+	// key's latest record instead. Off by default because every mismatch
+	// costs a full scan.
+	VerifyReads bool
+
+	// ReadHandles, if positive, lets Get read through up to this many
+	// extra read-only descriptors of the data file, kept open between
+	// calls, instead of sharing one handle among all concurrent readers.
+	// Writes still go through the single append handle. Costs up to this
+	// many file descriptors; readers beyond that share the main handle
+	// until one is free. Positioned reads on a shared descriptor do not
+	// serialize on Linux, so measure with atomkv-bench before relying on
+	// it there.
+	ReadHandles int
+
+	// ScanBufferSize, if non-zero, makes ForEach read the data file front
+	// to back through a buffered reader of this size instead of issuing
+	// one ReadAt per value. That is much faster for full scans unless most
+	// of the file is stale records, which the sequential reader still has
+	// to read past.
+	ScanBufferSize int
+
+	// ExpireInterval enables active expiration of keys written with
+	// SetWithTTL: every interval a background goroutine samples keys that
+	// have a TTL and drops the expired ones, sampling again straight away
+	// while more than a quarter of a sample had expired. Zero disables it;
+	// expired keys are still hidden from reads but keep their index slot
+	// until the next compaction.
+	ExpireInterval time.Duration
+
+	// ExpireSampleSize is the number of keys with a TTL examined per
+	// sample. Zero means 20.
+	ExpireSampleSize int
+
+	// MaxRecordAge, if non-zero, is a retention period applied by Compact:
+	// keys whose latest record is older than this are dropped, just as if
+	// they had been deleted. Until the next compaction they stay readable.
+	// Unlike a TTL it covers every key and costs nothing per write. It has
+	// no effect in TimestampLogical mode, where records carry no time.
+	MaxRecordAge time.Duration
+
+	// Now, if non-nil, replaces time.Now as the source of record
+	// timestamps, TTL expiry and MaxRecordAge, so tests can control time.
+	Now func() time.Time
+}
+
+// RetryPolicy describes how transient I/O errors are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	// Values below 2 disable retries.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry. It doubles after every
+	// further attempt.
+	Backoff time.Duration
+}
+
+// Logger is the logging interface used by Bitcask. *log.Logger
+// satisfies it.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Bitcask is an append-only key-value store with an in-memory index.
+type Bitcask struct {
+	file    *os.File // nil for databases opened with OpenFS
+	src     readFile // read side of the data file
+	fsys    fs.FS    // set for databases opened with OpenFS
+	path    string
+	claim   string   // key in openPaths; empty for read-only handles
+	dirty   *os.File // clean-shutdown marker this handle owns, if any
+	opts    Options
+	aead    cipher.AEAD // set when Options.EncryptionKey is; see encrypt.go
+	format  fileFormat
+	index   map[string]entry
+	records int64 // records in the file, including stale ones
+	dead    int64 // bytes of stale records; see DeadBytes
+	clock   int64 // last logical timestamp issued
+	end     int64 // offset just past the last record written
+	mu      sync.RWMutex
+
+	// wbuf holds records not yet written to the file; see writebuf.go.
+	// wmu guards it while only the read lock is held.
+	wbuf []byte
+	wmu  sync.Mutex
+
+	// generation counts file swaps; offsets from an older generation
+	// are stale.
+	generation uint64
+	compacting atomic.Bool
+	merging    sync.WaitGroup // running background compactions
+
+	// lastCompaction is when a compaction last finished; zero if none has
+	// since Open or Reset.
+	lastCompaction time.Time
+
+	// Operation counters for Stats, since Open or Reset.
+	sets, gets, deletes atomic.Uint64
+
+	// writesSinceDiskCheck counts writes since free space was last found
+	// sufficient; zero forces a check on the next write.
+	writesSinceDiskCheck int
+
+	watchMu  sync.Mutex
+	watchers map[*Subscription]struct{}
+
+	// ttlKeys holds the indexed keys that have an expiry, for the
+	// active expirer to sample from.
+	ttlKeys     map[string]struct{}
+	stopExpire  chan struct{}
+	expireDone  chan struct{}
+	stopExpirer sync.Once
+
+	// unsynced is set by writes and cleared by a successful fsync;
+	// the SyncInterval goroutine only syncs when it is set.
+	unsynced   atomic.Bool
+	stopSync   chan struct{}
+	syncDone   chan struct{}
+	stopSyncer sync.Once
+
+	// stopHint and hintDone control the SnapshotInterval goroutine,
+	// which Load starts.
+	stopHint    chan struct{}
+	hintDone    chan struct{}
+	stopHinting sync.Once
+
+	// segments are the sealed data files, oldest first, and nextSeg the
+	// id the next one gets; see segment.go.
+	segments []*segment
+	nextSeg  uint32
+
+	// readers is the pool of read descriptors when ReadHandles is set.
+	readers *readPool
+
+	// values holds every live value, encoded, when PreloadValues is set.
+	values map[string]string
+
+	// base is the read-only layer under a database opened with
+	// OpenLayered, and masked the base keys deleted in this overlay.
+	base   *Bitcask
+	masked map[string]struct{}
+}
+
+// entry locates the latest record for a key in the data file.
+type entry struct {
+	offset     int64
+	valueSize  uint32
+	vtype      valueType
+	timestamp  int64
+	expiry     int64  // Unix nanoseconds; zero means never
+	shared     bool   // the record holds a reference to the value; see dedup.go
+	meta       bool   // the value is followed by metadata; see meta.go
+	compressed bool   // the stored bytes are compressed; see compress.go
+	encrypted  bool   // the stored bytes are encrypted; see encrypt.go
+	seg        uint32 // sealed segment holding the record; 0 for the active file
+}
+
+// flags returns the record flags for e's value when copied in full.
+func (e entry) flags() uint8 {
+	flags := uint8(e.vtype)
+	if e.meta {
+		flags |= flagMeta
+	}
+	if e.compressed {
+		flags |= flagCompressed
+	}
+	if e.encrypted {
+		flags |= flagEncrypted
+	}
+	return flags
+}
+
+// packed reports whether e's stored bytes differ from its payload; see
+// storedPayload.
+func (e entry) packed() bool {
+	return e.compressed || e.encrypted
+}
+
+// expired reports whether e has an expiry at or before now.
+func (e entry) expired(now int64) bool {
+	return e.expiry != 0 && e.expiry <= now
+}
+
+// RecordInfo describes the on-disk record holding a key's current value.
+type RecordInfo struct {
+	Offset    int64  // position of the record in the data file
+	Segment   uint32 // sealed segment holding the record; 0 for the active file
+	Size      int64  // total record size: header, key and value
+	ValueSize int64
+	Timestamp time.Time // zero in TimestampLogical mode
+
+	// RawTimestamp is the value stored in the record: nanoseconds,
+	// milliseconds or a logical counter depending on the TimestampMode.
+	RawTimestamp int64
+
+	Expiry time.Time // zero if the key does not expire
+}
+
+// Stats is a snapshot of the database's size and state.
+type Stats struct {
+	Keys        int   // live keys in the index
+	Records     int64 // records in the file, including stale ones
+	FileSize    int64
+	Reclaimable int64 // bytes a compaction would free
+	Generation  uint64
+
+	// LargestValueKey is the live key with the largest value, and
+	// LargestValueSize its size. Both are zero when there are no keys.
+	LargestValueKey  string
+	LargestValueSize int64
+
+	// Sets, Gets and Deletes count the keys written, read and deleted
+	// since the database was opened or Reset, whichever method was used.
+	Sets, Gets, Deletes uint64
+
+	// LastCompaction is when the last compaction since Open or Reset
+	// finished, or the zero Time.
+	LastCompaction time.Time
+}
+
+// CompactResult describes the outcome of a compaction.
+type CompactResult struct {
+	RecordsBefore int64
+	RecordsAfter  int64
+	BytesBefore   int64
+	BytesAfter    int64
+	Pruned        int // keys dropped for exceeding MaxRecordAge
+	Duration      time.Duration
+}
+
+// Open creates or opens a Bitcask database at the given path.
+func Open(path string) (*Bitcask, error) {
+	return OpenWithOptions(path, Options{})
+}
+
+// OpenWithOptions creates or opens a Bitcask database at the given path
+// using the supplied options.
+//
+// A process may hold only one writable handle per path: opening the same
+// path for writing again before closing the first handle returns
+// ErrAlreadyOpen. Read-only handles are not limited.
+func OpenWithOptions(path string, opts Options) (_ *Bitcask, err error) {
+	opts = opts.withDefaults()
+
+	aead, err := newAEAD(opts.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var claim string
+	if !opts.ReadOnly {
+		if claim, err = claimPath(path); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				releasePath(claim)
+			}
+		}()
+	}
+
+	if opts.CreateDirs {
+		dir := filepath.Dir(path)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("create database directory %s: %w", dir, err)
+		}
+	}
+
+	// O_APPEND makes every write land at the end of the file whatever
+	// the file position, as with the handles compaction and Rotate open.
+	flag := os.O_CREATE | os.O_RDWR | os.O_APPEND
+	if opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+
+	file, err := os.OpenFile(path, flag, opts.FileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := readFileHeader(file, opts)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	end, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	b := &Bitcask{
+		file:    file,
+		src:     file,
+		path:    path,
+		claim:   claim,
+		opts:    opts,
+		format:  format,
+		index:   make(map[string]entry),
+		ttlKeys: make(map[string]struct{}),
+		end:     end,
+		aead:    aead,
+	}
+	if err := b.openSegments(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !opts.ReadOnly {
+		if b.dirty, err = markDirty(path); err != nil {
+			b.closeSegments(false)
+			file.Close()
+			return nil, err
+		}
+	}
+	if opts.PreloadValues {
+		b.values = make(map[string]string)
+	}
+	if opts.ReadHandles > 0 {
+		b.readers = newReadPool(path, opts.ReadHandles)
+	}
+	if opts.ExpireInterval > 0 {
+		b.startExpirer()
+	}
+	if opts.SyncInterval > 0 && !opts.ReadOnly {
+		b.startSyncer()
+	}
+	return b, nil
+}
+
+// withDefaults fills in the defaults for unset options.
+func (o Options) withDefaults() Options {
+	if o.CompactBufferSize <= 0 {
+		o.CompactBufferSize = defaultCompactBufferSize
+	}
+	if o.SlowSyncThreshold <= 0 {
+		o.SlowSyncThreshold = defaultSlowSyncThreshold
+	}
+	if o.FileMode == 0 {
+		o.FileMode = defaultFileMode
+	}
+	if o.WatchBufferSize <= 0 {
+		o.WatchBufferSize = defaultWatchBufferSize
+	}
+	if o.ExpireSampleSize <= 0 {
+		o.ExpireSampleSize = defaultExpireSampleSize
+	}
+	return o
+}
+
+// Set writes a key-value pair to disk and updates the in-memory index.
+func (b *Bitcask) Set(key, value string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.set(key, []byte(value), typeString, 0, nil)
+}
+
+// SetIfChanged writes value only if it differs from key's current value,
+// so idempotent writers do not grow the log. changed reports whether a
+// record was written. The comparison and the write happen under one lock.
+func (b *Bitcask) SetIfChanged(key, value string) (changed bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// The value's size is only known up front if it is stored plainly.
+	if e, exists := b.lookup(key); exists && e.vtype == typeString && (e.shared || e.meta || e.packed() || int(e.valueSize) == len(value)) {
+		current, err := b.readValue(key, e)
+		if err != nil {
+			return false, err
+		}
+		if string(current) == value {
+			return false, nil
+		}
+	}
+
+	if err := b.set(key, []byte(value), typeString, 0, nil); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CompareAndSwap writes new only if key's current value, as Get would
+// return it, equals old, and reports whether it did. The read and the
+// write happen under one lock, so of two concurrent calls expecting the
+// same old value only one succeeds. A missing key never matches; use
+// SetIfChanged or a sentinel value to create keys.
+func (b *Bitcask) CompareAndSwap(key, old, new string) (swapped bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.opts.ReadOnly {
+		return false, ErrReadOnly
+	}
+	raw, vt, err := b.rawValue(key)
+	if err == ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if vt.text(raw) != old {
+		return false, nil
+	}
+
+	if err := b.set(key, []byte(new), typeString, 0, nil); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// set implements Set and its typed, TTL and metadata variants: value is
+// encoded as vt, the record expires at expiry (Unix nanoseconds, zero for
+// never) and carries meta if it is non-empty. The caller holds the write
+// lock.
+func (b *Bitcask) set(key string, value []byte, vt valueType, expiry int64, meta map[string]string) error {
+	if b.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	payload, flags := value, uint8(vt)
+	if len(meta) > 0 {
+		payload = appendMeta(append([]byte(nil), value...), meta)
+		flags |= flagMeta
+	}
+	if err := b.checkSize(key, len(value), len(payload)); err != nil {
+		return err
+	}
+	if _, exists := b.index[key]; !exists && b.opts.MaxKeys > 0 && len(b.index) >= b.opts.MaxKeys {
+		return ErrMaxKeysReached
+	}
+	if err := b.checkDiskSpace(); err != nil {
+		return err
+	}
+	if err := b.sealIfFull(); err != nil {
+		return err
+	}
+
+	offset := b.end
+	stored, flags, err := b.storedPayload(key, payload, flags)
+	if err != nil {
+		return err
+	}
+
+	// Buffer the entire record before writing
+	timestamp := b.nextTimestamp()
+	record := b.format.encodeRecord(nil, timestamp, expiry, flags, key, stored, false)
+
+	if err := b.appendRecord(record); err != nil {
+		return err
+	}
+	if b.opts.SyncOnWrite {
+		if err := b.syncFile(); err != nil {
+			return err
+		}
+	}
+
+	b.indexPut(key, entry{
+		offset:     offset,
+		valueSize:  uint32(len(stored)),
+		vtype:      vt,
+		timestamp:  timestamp,
+		expiry:     expiry,
+		meta:       len(meta) > 0,
+		compressed: flags&flagCompressed != 0,
+		encrypted:  flags&flagEncrypted != 0,
+	})
+	b.cacheValue(key, value)
+	b.records++
+	b.sets.Add(1)
+
+	b.publish(Event{Key: key, Value: vt.text(value), Timestamp: b.timeOf(timestamp)})
+	b.maybeCompact()
+	return nil
+}
+
+// checkSize rejects a write whose key or value is too large: a value of
+// valueSize bytes must fit MaxValueSize, and the key and the stored bytes,
+// metadata included, must fit the record's size fields. Without this check
+// a value over 4GB would wrap its length and corrupt the file.
+func (b *Bitcask) checkSize(key string, valueSize, storedSize int) error {
+	if uint64(len(key)) > maxKeySize {
+		return ErrKeyTooLarge
+	}
+	if b.opts.MaxValueSize > 0 && valueSize > b.opts.MaxValueSize {
+		return ErrValueTooLarge
+	}
+	if uint64(storedSize) > maxValueSize {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// Delete removes key by appending a tombstone record. It returns
+// ErrKeyNotFound if the key does not exist.
+func (b *Bitcask) Delete(key string) error {
+	n, err := b.DeleteMulti([]string{key})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// DeleteMulti removes every existing key in keys and returns how many were
+// removed. Missing keys are ignored. All tombstones go to disk in a single
+// write before the index changes, so either every key is deleted or, if
+// the write fails, none is.
+func (b *Bitcask) DeleteMulti(keys []string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.opts.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	seen := make(map[string]bool, len(keys))
+	var deleted []string
+	for _, key := range keys {
+		if b.exists(key) && !seen[key] {
+			seen[key] = true
+			deleted = append(deleted, key)
+		}
+	}
+	if len(deleted) == 0 {
+		return 0, nil
+	}
+	if err := b.checkDiskSpace(); err != nil {
+		return 0, err
+	}
+
+	timestamp := b.nextTimestamp()
+	var buf []byte
+	for _, key := range deleted {
+		buf = b.format.encodeRecord(buf, timestamp, 0, uint8(typeString), key, nil, true)
+	}
+
+	if err := b.sealIfFull(); err != nil {
+		return 0, err
+	}
+	if err := b.appendRecord(buf); err != nil {
+		return 0, err
+	}
+	if b.opts.SyncOnWrite {
+		if err := b.syncFile(); err != nil {
+			return 0, err
+		}
+	}
+
+	b.deletes.Add(uint64(len(deleted)))
+	b.dead += int64(len(buf))
+	for _, key := range deleted {
+		b.indexDelete(key)
+		b.records++
+		b.publish(Event{Key: key, Deleted: true, Timestamp: b.timeOf(timestamp)})
+	}
+	b.maybeCompact()
+	return len(deleted), nil
+}
+
+// Get retrieves a value by key using the in-memory index.
+//
+// Reads never observe a concurrent overwrite: Get holds the read lock for
+// the whole read, so Set (which needs the write lock) cannot append until it
+// returns, and ReadAt uses absolute offsets that are unaffected by
+// O_APPEND. Records are never modified once written.
+//
+// Writes are visible as soon as they return: every write appends its
+// record and updates the index under the write lock, so a Get that starts
+// after a Set returns finds the new record, whether it is read from the
+// file, the write buffer or PreloadValues' copy.
+func (b *Bitcask) Get(key string) (string, error) {
+	value, _, err := b.GetWithMeta(key)
+	return value, err
+}
+
+// GetWithMeta is like Get but also returns when the value was written,
+// decoded from the record's timestamp the same way Watch events are. With
+// TimestampLogical the timestamp is a counter and ts is the zero Time; see
+// KeyInfo for the raw value.
+func (b *Bitcask) GetWithMeta(key string) (value string, ts time.Time, err error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	b.gets.Add(1)
+	return b.get(key)
+}
+
+// GetMulti returns the values of keys as a map, omitting keys that do not
+// exist. It takes the read lock once for all of them, so a page of reads
+// costs one lock round trip and sees a single point in time. Any error
+// other than a missing key stops it.
+func (b *Bitcask) GetMulti(keys []string) (map[string]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	b.gets.Add(uint64(len(keys)))
+
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value, _, err := b.get(key)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get %q: %w", key, err)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// get is GetWithMeta for a caller holding the read lock.
+func (b *Bitcask) get(key string) (value string, ts time.Time, err error) {
+	e, exists := b.lookup(key)
+	if !exists {
+		if b.fromBase(key) {
+			return b.base.GetWithMeta(key)
+		}
+		return "", time.Time{}, ErrKeyNotFound
+	}
+	ts = b.timeOf(e.timestamp)
+	if v, ok := b.values[key]; ok {
+		if e.vtype == typeString {
+			return v, ts, nil
+		}
+		return e.vtype.text([]byte(v)), ts, nil
+	}
+
+	vt := e.vtype
+	var valueBytes []byte
+	if b.opts.VerifyReads {
+		valueBytes, vt, err = b.readVerified(key, e)
+	} else {
+		valueBytes, err = b.readValue(key, e)
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return vt.text(valueBytes), ts, nil
+}
+
+// KeyInfo returns storage metadata for key's current record without
+// reading its value. Offsets change when the database is compacted; see
+// Generation.
+func (b *Bitcask) KeyInfo(key string) (RecordInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	e, exists := b.lookup(key)
+	if !exists {
+		return RecordInfo{}, ErrKeyNotFound
+	}
+
+	info := RecordInfo{
+		Offset:       e.offset,
+		Segment:      e.seg,
+		Size:         b.format.recordSize(len(key), e.valueSize),
+		ValueSize:    int64(e.valueSize),
+		Timestamp:    b.timeOf(e.timestamp),
+		RawTimestamp: e.timestamp,
+	}
+	if e.expiry != 0 {
+		info.Expiry = time.Unix(0, e.expiry)
+	}
+	return info, nil
+}
+
+// Lookup is the comma-ok form of Get: found reports whether key exists,
+// so an empty value is distinguishable from a missing key without
+// comparing errors. A failed read also reports found as false; use Get when
+// I/O errors must be told apart from missing keys.
+func (b *Bitcask) Lookup(key string) (value string, found bool) {
+	value, err := b.Get(key)
+	return value, err == nil
+}
+
+// Len returns the number of live keys without allocating. Only keys with
+// a TTL are examined individually, to leave out expired ones.
+func (b *Bitcask) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	now := b.now().UnixNano()
+	n := len(b.index)
+	for key := range b.ttlKeys {
+		if b.index[key].expired(now) {
+			n--
+		}
+	}
+	return n + len(b.baseKeys(""))
+}
+
+// Exists reports whether key is present, consulting only the in-memory
+// index: the file is never read. Deleted and expired keys are absent.
+func (b *Bitcask) Exists(key string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.exists(key)
+}
+
+// Equal reports whether key1 and key2 hold the same value, without
+// returning either. Values of different types or sizes are unequal without
+// reading them, and keys sharing one stored value (see CompactDedupValues)
+// are equal without reading it; otherwise both values are read and
+// compared. It returns ErrKeyNotFound if either key is missing.
+func (b *Bitcask) Equal(key1, key2 string) (bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	e1, ok1 := b.lookup(key1)
+	e2, ok2 := b.lookup(key2)
+	if ok1 && ok2 {
+		if e1.vtype != e2.vtype {
+			return false, nil
+		}
+		if !e1.shared && !e2.shared && !e1.meta && !e2.meta && !e1.packed() && !e2.packed() && e1.valueSize != e2.valueSize {
+			return false, nil
+		}
+		if e1.shared && e2.shared {
+			off1, _, err := b.valueLocation(key1, e1)
+			if err != nil {
+				return false, err
+			}
+			off2, _, err := b.valueLocation(key2, e2)
+			if err != nil {
+				return false, err
+			}
+			if off1 == off2 {
+				return true, nil
+			}
+		}
+	}
+
+	v1, t1, err := b.rawValue(key1)
+	if err != nil {
+		return false, err
+	}
+	v2, t2, err := b.rawValue(key2)
+	if err != nil {
+		return false, err
+	}
+	return t1 == t2 && bytes.Equal(v1, v2), nil
+}
+
+// rawValue returns key's encoded value and type, looking in memory, the
+// file and the base layer in turn. The caller holds the read lock.
+func (b *Bitcask) rawValue(key string) ([]byte, valueType, error) {
+	e, exists := b.lookup(key)
+	if !exists {
+		if b.fromBase(key) {
+			return b.base.getRaw(key)
+		}
+		return nil, 0, ErrKeyNotFound
+	}
+	if v, ok := b.values[key]; ok {
+		return []byte(v), e.vtype, nil
+	}
+	raw, err := b.readValue(key, e)
+	if err != nil {
+		return nil, 0, err
+	}
+	return raw, e.vtype, nil
+}
+
+// readValue reads the value of key's record described by e. The whole
+// record is read so that its checksum, if the format has one, can be
+// verified, and its key is compared with key so that a wrong index offset
+// cannot return another key's value; either mismatch returns an error
+// wrapping ErrCorruptRecord. A shared value is resolved by reading the
+// record it refers to.
+func (b *Bitcask) readValue(key string, e entry) ([]byte, error) {
+	payload, err := b.readPayload(key, e)
+	if err != nil || !e.meta {
+		return payload, err
+	}
+	return stripMeta(payload)
+}
+
+// readPayload is readValue without removing metadata that follows the
+// value.
+func (b *Bitcask) readPayload(key string, e entry) ([]byte, error) {
+	stored, err := b.readStored(key, e)
+	if err != nil || !e.packed() {
+		return stored, err
+	}
+	return b.unpack(key, stored, e.flags())
+}
+
+// readStored is readPayload without decompressing: it returns the bytes a
+// copy of the record with e.flags() should hold.
+func (b *Bitcask) readStored(key string, e entry) ([]byte, error) {
+	record, err := b.readRecord(e.seg, e.offset, len(key), e.valueSize)
+	if err != nil {
+		return nil, err
+	}
+	value, err := b.format.keyedRecordValue(record, key, e.offset)
+	if err != nil || !e.shared {
+		return value, err
+	}
+	return b.resolveShared(e.seg, value)
+}
+
+// readRecord reads the record at offset in segment seg with the given key
+// and value sizes.
+func (b *Bitcask) readRecord(seg uint32, offset int64, keySize int, valueSize uint32) ([]byte, error) {
+	record := make([]byte, b.format.recordSize(keySize, valueSize))
+	err := b.retry("read", func() error {
+		if seg != 0 {
+			_, err := b.segmentFile(seg).ReadAt(record, offset)
+			return err
+		}
+		_, err := b.readAt(record, offset)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// readRecordValue reads the record at offset in segment seg and returns
+// its value after verifying the checksum.
+func (b *Bitcask) readRecordValue(seg uint32, offset int64, keySize int, valueSize uint32) ([]byte, error) {
+	record, err := b.readRecord(seg, offset, keySize, valueSize)
+	if err != nil {
+		return nil, err
+	}
+	return b.format.recordValue(record, keySize)
+}
+
+// checkDiskSpace returns ErrDiskFull if MinFreeDiskBytes is set and the
+// filesystem has less space available. The caller holds the write lock.
+func (b *Bitcask) checkDiskSpace() error {
+	if b.opts.MinFreeDiskBytes == 0 {
+		return nil
+	}
+	if b.writesSinceDiskCheck > 0 && b.writesSinceDiskCheck < diskCheckInterval {
+		b.writesSinceDiskCheck++
+		return nil
+	}
+
+	free, ok, err := freeDiskBytes(b.path)
+	if err != nil {
+		return err
+	}
+	if ok && free < b.opts.MinFreeDiskBytes {
+		b.writesSinceDiskCheck = 0
+		return ErrDiskFull
+	}
+	b.writesSinceDiskCheck = 1
+	return nil
+}
+
+// appendRecord writes record at b.end, the current end of the file.
+// Before a retry, and after a write that finally fails, it truncates
+// whatever the failed attempt left behind so a partial record never
+// precedes the complete one and the next write starts at b.end. The file
+// is opened with O_APPEND, so truncating is enough to put it there.
+func (b *Bitcask) appendRecord(record []byte) error {
+	if b.opts.WriteBufferSize > 0 {
+		return b.bufferRecord(record)
+	}
+	offset := b.end
+	attempt := 0
+	err := b.retry("write", func() error {
+		if attempt++; attempt > 1 {
+			if err := b.file.Truncate(offset); err != nil {
+				return err
+			}
+		}
+		_, err := b.file.Write(record)
+		return err
+	})
+	if err != nil {
+		b.file.Truncate(offset)
+		return err
+	}
+	b.end = offset + int64(len(record))
+	b.unsynced.Store(true)
+	return nil
+}
+
+// retry runs fn, retrying it according to the configured RetryPolicy.
+// The error from the final attempt is returned.
+func (b *Bitcask) retry(op string, fn func() error) error {
+	policy := b.opts.Retry
+	backoff := policy.Backoff
+
+	err := fn()
+	for attempt := 1; err != nil && attempt < policy.MaxAttempts; attempt++ {
+		b.logf("atomkv: %s failed (attempt %d of %d), retrying in %v: %v",
+			op, attempt, policy.MaxAttempts, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		err = fn()
+	}
+	return err
+}
+
+func (b *Bitcask) logf(format string, v ...any) {
+	if b.opts.Logger != nil {
+		b.opts.Logger.Printf(format, v...)
+	}
+}
+
+// warnf is logf for messages that must not be discarded, such as data
+// being dropped: without a Logger they go to the standard logger.
+func (b *Bitcask) warnf(format string, v ...any) {
+	if b.opts.Logger != nil {
+		b.opts.Logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// now returns the current time from Options.Now, or time.Now if unset.
+func (b *Bitcask) now() time.Time {
+	if b.opts.Now != nil {
+		return b.opts.Now()
+	}
+	return time.Now()
+}
+
+// Load rebuilds the in-memory index from the data file. The file is read
+// front to back through a buffer, checksumming values without keeping them.
+//
+// A torn last record, one a crash left incomplete or failing its checksum,
+// makes Load return an error describing it. With Options.RepairOnLoad the
+// records before it are indexed instead and the rest is logged; a writable
+// handle also truncates the file there so new writes stay readable. A
+// record that fails its checksum with more data after it is corruption
+// rather than a torn write: Load returns an error wrapping ErrCorruptRecord
+// and leaves the file as it is, whatever the options.
+func (b *Bitcask) Load() error {
+	return b.LoadContext(context.Background())
+}
+
+// LoadContext is Load, checking ctx between records. If ctx is done it
+// returns ctx.Err() with the records read so far indexed: the index is
+// consistent but may miss later writes and hold older values, so Load
+// should be called again before the database is used.
+func (b *Bitcask) LoadContext(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.load(ctx); err != nil {
+		return err
+	}
+	// A hint written before the index describes the file would drop
+	// every key, so periodic hints wait for the first Load.
+	if b.opts.SnapshotInterval > 0 && !b.opts.ReadOnly && b.fsys == nil && b.stopHint == nil {
+		b.startHintWriter()
+	}
+	return nil
+}
+
+// load rebuilds the index for LoadContext. The caller holds the write lock.
+func (b *Bitcask) load(ctx context.Context) error {
+	if err := b.flushWrites(); err != nil {
+		return err
+	}
+	info, err := b.src.Stat()
+	if err != nil {
+		return err
+	}
+
+	b.records = 0
+	if b.loadHint(info) {
+		if b.dead, err = b.reclaimable(); err != nil {
+			return err
+		}
+		return b.preload(b.keysByOffset())
+	}
+	if err := b.loadSegments(ctx); err != nil {
+		return err
+	}
+	next, err := scanRecords(b.src, b.format, b.format.dataStart, info.Size(), func(offset int64, h recordHeader, key []byte) error {
+		b.applyRecord(0, offset, h, key)
+		return ctx.Err()
+	})
+	if err != nil && (!damagedTail(err) || !b.opts.RepairOnLoad) {
+		return loadError(b.path, next, err)
+	}
+	if err != nil {
+		// Appending after a torn record would leave every later record
+		// unreachable, so a writable handle cuts the file there.
+		b.end = next
+		if b.opts.ReadOnly {
+			b.logf("atomkv: %s: ignoring %d bytes from offset %d: %v", b.path, info.Size()-next, next, err)
+		} else {
+			b.warnf("atomkv: %s: truncating %d bytes from offset %d: %v", b.path, info.Size()-next, next, err)
+			if err := b.file.Truncate(next); err != nil {
+				return err
+			}
+		}
+	}
+	if b.dead, err = b.reclaimable(); err != nil {
+		return err
+	}
+	return b.preload(b.keysByOffset())
+}
+
+// applyRecord updates the index and counters for a record read from
+// segment seg (0 for the active file). The caller holds the write lock.
+func (b *Bitcask) applyRecord(seg uint32, offset int64, h recordHeader, key []byte) {
+	b.records++
+	if b.format.tsMode == TimestampLogical && h.timestamp > b.clock {
+		b.clock = h.timestamp
+	}
+	// A record that has expired deletes its key just like a tombstone,
+	// so a restart does not resurrect it.
+	e := entry{
+		offset:     offset,
+		valueSize:  h.valueSize,
+		vtype:      valueType(h.flags & typeMask),
+		timestamp:  h.timestamp,
+		expiry:     h.expiry,
+		shared:     h.flags&flagShared != 0,
+		meta:       h.flags&flagMeta != 0,
+		compressed: h.flags&flagCompressed != 0,
+		encrypted:  h.flags&flagEncrypted != 0,
+		seg:        seg,
+	}
+	if h.valueSize == tombstone || e.expired(b.now().UnixNano()) {
+		b.indexDelete(string(key))
+		return
+	}
+	b.indexPut(string(key), e)
+}
+
+// lookup returns key's index entry, treating an expired key as missing.
+func (b *Bitcask) lookup(key string) (entry, bool) {
+	e, ok := b.index[key]
+	if !ok || e.expired(b.now().UnixNano()) {
+		return entry{}, false
+	}
+	return e, true
+}
+
+// indexPut and indexDelete update the index and the set of keys with a
+// TTL together. The caller holds the write lock.
+func (b *Bitcask) indexPut(key string, e entry) {
+	b.addDead(key)
+	b.index[key] = e
+	delete(b.masked, key)
+	if e.expiry != 0 {
+		b.ttlKeys[key] = struct{}{}
+	} else {
+		delete(b.ttlKeys, key)
+	}
+}
+
+func (b *Bitcask) indexDelete(key string) {
+	b.addDead(key)
+	delete(b.index, key)
+	delete(b.ttlKeys, key)
+	delete(b.values, key)
+	if b.base != nil {
+		b.masked[key] = struct{}{}
+	}
+}
+
+// addDead counts key's current record, which is about to be superseded,
+// as dead. The caller holds the write lock.
+func (b *Bitcask) addDead(key string) {
+	if old, ok := b.index[key]; ok {
+		b.dead += b.format.recordSize(len(key), old.valueSize)
+	}
+}
+
+// setIndex replaces the whole index. The caller holds the write lock.
+func (b *Bitcask) setIndex(index map[string]entry) {
+	b.index = index
+	b.ttlKeys = make(map[string]struct{})
+	for key, e := range index {
+		if e.expiry != 0 {
+			b.ttlKeys[key] = struct{}{}
+		}
+	}
+	for key := range b.values {
+		if _, ok := index[key]; !ok {
+			delete(b.values, key)
+		}
+	}
+}
+
+// Compact creates a new file with only the latest value for each key.
+// Values are streamed through a fixed-size buffer, so memory use does not
+// grow with value size.
+func (b *Bitcask) Compact() error {
+	return b.CompactContext(context.Background())
+}
+
+// CompactContext is Compact, checking ctx between records. If ctx is done
+// it returns ctx.Err() and the data file is left untouched.
+func (b *Bitcask) CompactContext(ctx context.Context) error {
+	_, err := b.compactWithStats(ctx)
+	return err
+}
+
+// CompactWithStats compacts the database like Compact and reports how many
+// records and bytes it reclaimed.
+//
+// If another compaction is already running it returns
+// ErrCompactionInProgress immediately instead of queueing behind it.
+func (b *Bitcask) CompactWithStats() (CompactResult, error) {
+	return b.compactWithStats(context.Background())
+}
 
-// Bitcask is an append-only key-value store with an in-memory index.
-type Bitcask struct {
-	file  *os.File
-	path  string
-	index map[string]int64
-	mu    sync.RWMutex
+func (b *Bitcask) compactWithStats(ctx context.Context) (CompactResult, error) {
+	if b.opts.ReadOnly {
+		return CompactResult{}, ErrReadOnly
+	}
+	if !b.compacting.CompareAndSwap(false, true) {
+		return CompactResult{}, ErrCompactionInProgress
+	}
+	defer b.compacting.Store(false)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.compact(ctx)
 }
 
-// Open creates or opens a Bitcask database at the given path.
-func Open(path string) (*Bitcask, error) {
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+// compact rewrites the data file keeping only the latest record for each
+// key. The caller holds the write lock and the compacting flag.
+func (b *Bitcask) compact(ctx context.Context) (CompactResult, error) {
+	// Compaction also upgrades files written by older versions, which
+	// gain checksums of the configured type.
+	format := fileFormat{
+		version:   formatVersion,
+		tsMode:    b.format.tsMode,
+		checksum:  b.opts.ChecksumType,
+		dataStart: fileHeaderSize,
+	}
+	if b.format.checksummed() {
+		format.checksum = b.format.checksum
+	}
+	return b.rewrite(ctx, format, nil)
+}
+
+// rewrite replaces the data file with one in the given format holding only
+// the latest record for each key. If stamp is non-nil it supplies each
+// record's new timestamp. If ctx is done before the copy finishes the
+// data file is left as it was. The caller holds the write lock and the
+// compacting flag.
+func (b *Bitcask) rewrite(ctx context.Context, format fileFormat, stamp func(key string, e entry) int64) (CompactResult, error) {
+	start := time.Now()
+	if err := b.flushWrites(); err != nil {
+		return CompactResult{}, err
+	}
+	info, err := b.src.Stat()
 	if err != nil {
-		return nil, err
+		return CompactResult{}, err
 	}
+	result := CompactResult{
+		RecordsBefore: b.records,
+		BytesBefore:   info.Size() + b.segmentsSize(),
+	}
+	format.sealed = b.nextSeg - 1
 
-	return &Bitcask{
-		file:  file,
-		path:  path,
-		index: make(map[string]int64),
-	}, nil
-}
+	tempPath := b.path + ".tmp"
+	tempFile, err := os.OpenFile(tempPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, b.opts.FileMode)
+	if err != nil {
+		return CompactResult{}, err
+	}
 
-// Set writes a key-value pair to disk and updates the in-memory index.
-func (b *Bitcask) Set(key, value string) error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
+	if err := writeFileHeader(tempFile, format); err != nil {
+		tempFile.Close()
+		os.Remove(tempPath)
+		return CompactResult{}, err
+	}
 
-	offset, err := b.file.Seek(0, io.SeekEnd)
+	newIndex, size, err := b.copyLive(ctx, tempFile, format, stamp)
 	if err != nil {
-		return err
+		tempFile.Close()
+		os.Remove(tempPath)
+		return CompactResult{}, err
 	}
 
-	// Buffer the entire record before writing
-	keyBytes := []byte(key)
-	valueBytes := []byte(value)
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, time.Now().UnixNano())
-	binary.Write(buf, binary.LittleEndian, uint32(len(keyBytes)))
-	binary.Write(buf, binary.LittleEndian, uint32(len(valueBytes)))
-	buf.Write(keyBytes)
-	buf.Write(valueBytes)
+	b.file.Close()
+	tempFile.Close()
 
-	if _, err := b.file.Write(buf.Bytes()); err != nil {
-		return err
+	if err := os.Rename(tempPath, b.path); err != nil {
+		return CompactResult{}, err
 	}
 
-	b.index[key] = offset
-	return nil
+	newFile, err := os.OpenFile(b.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, b.opts.FileMode)
+	if err != nil {
+		return CompactResult{}, err
+	}
+
+	// Live keys missing from the new file were pruned by MaxRecordAge.
+	now := b.now()
+	var pruned []string
+	for key, e := range b.index {
+		if _, ok := newIndex[key]; !ok && !e.expired(now.UnixNano()) {
+			pruned = append(pruned, key)
+		}
+	}
+
+	b.file = newFile
+	b.src = newFile
+	b.format = format
+	b.setIndex(newIndex)
+	b.end = size
+	b.nextGeneration()
+	b.records = int64(len(newIndex) + len(b.masked))
+	b.dead = 0
+
+	// The new file's header marks the segments as merged, so one left
+	// behind here is dropped when the database is next opened.
+	if err := b.closeSegments(true); err != nil {
+		b.logf("atomkv: %s: removing merged segments: %v", b.path, err)
+	}
+
+	for _, key := range pruned {
+		b.publish(Event{Key: key, Deleted: true, Timestamp: now})
+	}
+
+	// The hint only speeds up the next Load, so failing to write it
+	// does not fail the compaction.
+	if err := b.writeHint(); err != nil {
+		b.logf("atomkv: %s: writing hint file: %v", b.path, err)
+	}
+
+	b.lastCompaction = b.now()
+	result.RecordsAfter = b.records
+	result.BytesAfter = size
+	result.Pruned = len(pruned)
+	result.Duration = time.Since(start)
+	return result, nil
 }
 
-// Get retrieves a value by key using the in-memory index.
-func (b *Bitcask) Get(key string) (string, error) {
+// retentionCutoff returns the oldest record timestamp MaxRecordAge keeps,
+// in the file's timestamp units. ok is false when there is no retention
+// period or the timestamps are logical.
+func (b *Bitcask) retentionCutoff() (cutoff int64, ok bool) {
+	if b.opts.MaxRecordAge <= 0 {
+		return 0, false
+	}
+	oldest := b.now().Add(-b.opts.MaxRecordAge)
+	switch b.format.tsMode {
+	case TimestampMillis:
+		return oldest.UnixMilli(), true
+	case TimestampLogical:
+		return 0, false
+	default:
+		return oldest.UnixNano(), true
+	}
+}
+
+// copyLive writes the latest record for every indexed key to dst in the
+// given format, starting at format.dataStart, and returns the index for the
+// new file along with the resulting file size. Records keep their timestamps
+// unless stamp is non-nil.
+//
+// A record's stored checksum is copied as is when neither the algorithm
+// nor the timestamp changes, so corruption in the source stays detectable.
+// Otherwise the checksum is computed while the value streams through and
+// written into the header afterwards. Shared values are copied in full
+// unless CompactDedupValues shares them again. Keys older than
+// MaxRecordAge are left out. ctx is checked before each key.
+func (b *Bitcask) copyLive(ctx context.Context, dst *os.File, format fileFormat, stamp func(key string, e entry) int64) (map[string]entry, int64, error) {
+	newIndex := make(map[string]entry, len(b.index))
+	buf := make([]byte, b.opts.CompactBufferSize)
+	header := make([]byte, format.recordHeaderSize())
+	keepChecksums := stamp == nil && b.format.checksummed() &&
+		b.format.version == format.version && b.format.checksum == format.checksum
+	var dedup *dedupTable
+	if b.opts.CompactDedupValues && format.hasFlags() {
+		dedup = newDedupTable(format, len(buf))
+	}
+
+	// Hide dst's ReadFrom so io.CopyBuffer uses buf instead of
+	// allocating its own.
+	w := struct{ io.Writer }{dst}
+
+	// Keep write order unless sorted output was asked for; reading in
+	// file order also makes the copy sequential.
+	keys := b.keysByOffset()
+	if b.opts.CompactSorted {
+		sort.Strings(keys)
+	}
+
+	if _, err := dst.Seek(format.dataStart, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	cutoff, retain := b.retentionCutoff()
+	newOffset := format.dataStart
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		e := b.index[key]
+		if retain && e.timestamp < cutoff {
+			continue
+		}
+		if stamp != nil {
+			e.timestamp = stamp(key, e)
+		}
+
+		valueOffset, valueSize, err := b.valueLocation(key, e)
+		if err != nil {
+			return nil, 0, err
+		}
+		src := b.segmentFile(e.seg)
+		var value io.Reader = io.NewSectionReader(src, valueOffset, int64(valueSize))
+		if dedup != nil && !e.meta && !e.packed() && dedup.eligible(valueSize) {
+			v := buf[:valueSize]
+			if _, err := src.ReadAt(v, valueOffset); err != nil {
+				return nil, 0, err
+			}
+			ref, found, err := dedup.find(dst, v, e.vtype)
+			if err != nil {
+				return nil, 0, err
+			}
+			if found {
+				record := format.encodeRecord(nil, e.timestamp, e.expiry, uint8(e.vtype)|flagShared, key, ref, false)
+				if _, err := dst.Write(record); err != nil {
+					return nil, 0, err
+				}
+				e.offset, e.valueSize, e.shared, e.seg = newOffset, sharedRefSize, true, 0
+				newIndex[key] = e
+				newOffset += int64(len(record))
+				continue
+			}
+			dedup.add(v, e.vtype, newOffset, len(key))
+			value = bytes.NewReader(v)
+		}
+
+		format.putHeader(header, recordHeader{
+			timestamp: e.timestamp,
+			expiry:    e.expiry,
+			flags:     e.flags(),
+			keySize:   uint32(len(key)),
+			valueSize: valueSize,
+		})
+		if keepChecksums && !e.shared {
+			if _, err := src.ReadAt(header[:checksumSize], e.offset); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		var sum checksummer
+		out := w
+		if format.checksummed() && (!keepChecksums || e.shared) {
+			sum = format.checksum.new()
+			sum.Write(header[checksumSize:])
+			sum.Write([]byte(key))
+			out = struct{ io.Writer }{io.MultiWriter(dst, sum)}
+		}
+
+		if _, err := dst.Write(header); err != nil {
+			return nil, 0, err
+		}
+		if _, err := dst.Write([]byte(key)); err != nil {
+			return nil, 0, err
+		}
+
+		n, err := io.CopyBuffer(out, value, buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		if n != int64(valueSize) {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+
+		if sum != nil {
+			binary.LittleEndian.PutUint64(header, sum.Sum64())
+			if _, err := dst.WriteAt(header[:checksumSize], newOffset); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		newIndex[key] = entry{
+			offset:     newOffset,
+			valueSize:  valueSize,
+			vtype:      e.vtype,
+			timestamp:  e.timestamp,
+			expiry:     e.expiry,
+			meta:       e.meta,
+			compressed: e.compressed,
+			encrypted:  e.encrypted,
+		}
+		newOffset += format.recordSize(len(key), valueSize)
+	}
+
+	// Tombstones hiding base keys of a layered database must survive.
+	for _, key := range b.maskedKeys() {
+		record := format.encodeRecord(nil, 0, 0, 0, key, nil, true)
+		if _, err := dst.Write(record); err != nil {
+			return nil, 0, err
+		}
+		newOffset += int64(len(record))
+	}
+
+	return newIndex, newOffset, nil
+}
+
+// Keys returns all keys in the database.
+func (b *Bitcask) Keys() []string {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
-	offset, exists := b.index[key]
-	if !exists {
-		return "", ErrKeyNotFound
+	now := b.now().UnixNano()
+	keys := make([]string, 0, len(b.index))
+	for k, e := range b.index {
+		if !e.expired(now) {
+			keys = append(keys, k)
+		}
 	}
+	return append(keys, b.baseKeys("")...)
+}
+
+// Scan returns every key starting with prefix, in ascending order. Use
+// KeysWithPrefix to bound the result, or ScanValues to read the values too.
+func (b *Bitcask) Scan(prefix string) []string {
+	keys, _ := b.KeysWithPrefix(prefix, 0)
+	return keys
+}
+
+// KeysWithPrefix returns the keys starting with prefix in ascending order.
+// If limit is positive at most limit keys are returned, the smallest ones,
+// and truncated reports whether any were left out. Memory use is bounded
+// by limit rather than by the number of matching keys.
+func (b *Bitcask) KeysWithPrefix(prefix string, limit int) (keys []string, truncated bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-	// Read header: timestamp(8) + keySize(4) + valueSize(4) = 16 bytes
-	header := make([]byte, 16)
-	if _, err := b.file.ReadAt(header, offset); err != nil {
-		return "", err
+	now := b.now().UnixNano()
+	h := &keyHeap{}
+	add := func(k string) {
+		if limit <= 0 || h.Len() < limit {
+			heap.Push(h, k)
+			return
+		}
+		truncated = true
+		if k < (*h)[0] {
+			(*h)[0] = k
+			heap.Fix(h, 0)
+		}
 	}
+	for k, e := range b.index {
+		if strings.HasPrefix(k, prefix) && !e.expired(now) {
+			add(k)
+		}
+	}
+	for _, k := range b.baseKeys(prefix) {
+		add(k)
+	}
+
+	keys = []string(*h)
+	sort.Strings(keys)
+	return keys, truncated
+}
+
+// keyHeap is a max-heap of keys, so the largest kept key is the one a
+// smaller candidate replaces.
+type keyHeap []string
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h keyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(x any)        { *h = append(*h, x.(string)) }
+func (h *keyHeap) Pop() any {
+	old := *h
+	k := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return k
+}
 
-	keySize := binary.LittleEndian.Uint32(header[8:12])
-	valueSize := binary.LittleEndian.Uint32(header[12:16])
+// ScanValues calls fn for every key starting with prefix, in ascending key
+// order, together with its value. Values are read one at a time as the scan
+// reaches them. If fn returns an error the scan stops and ScanValues
+// returns that error.
+//
+// The read lock is held for the whole scan, so fn must not write to the
+// database.
+func (b *Bitcask) ScanValues(prefix string, fn func(key, value string) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-	// Read value at offset + header + key
-	valueBytes := make([]byte, valueSize)
-	valueOffset := offset + 16 + int64(keySize)
-	if _, err := b.file.ReadAt(valueBytes, valueOffset); err != nil {
-		return "", err
+	now := b.now().UnixNano()
+	var keys []string
+	for k, e := range b.index {
+		if strings.HasPrefix(k, prefix) && !e.expired(now) {
+			keys = append(keys, k)
+		}
 	}
+	keys = append(keys, b.baseKeys(prefix)...)
+	sort.Strings(keys)
 
-	return string(valueBytes), nil
+	for _, k := range keys {
+		e, ok := b.index[k]
+		if !ok {
+			value, err := b.base.Get(k)
+			if err == ErrKeyNotFound {
+				continue // expired since it was listed
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(k, value); err != nil {
+				return err
+			}
+			continue
+		}
+		value, err := b.readValue(k, e)
+		if err != nil {
+			return err
+		}
+		if err := fn(k, e.vtype.text(value)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Load rebuilds the in-memory index from the data file.
-func (b *Bitcask) Load() error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
+// ForEach calls fn for every key and value in the order the records appear
+// in the data file. If fn returns an error the scan stops and ForEach
+// returns that error. See Options.ScanBufferSize for how values are read.
+//
+// The read lock is held for the whole scan, so fn must not write to the
+// database.
+func (b *Bitcask) ForEach(fn func(key, value string) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+	if err := b.forEach(fn); err != nil || b.base == nil {
 		return err
 	}
+	return b.base.ForEach(func(key, value string) error {
+		if !b.fromBase(key) {
+			return nil
+		}
+		return fn(key, value)
+	})
+}
+
+// forEach is ForEach without the base layer. The caller holds the read
+// lock.
+func (b *Bitcask) forEach(fn func(key, value string) error) error {
+	keys := b.keysByOffset()
+	if b.opts.ScanBufferSize > 0 {
+		return b.scanSequential(keys, fn)
+	}
 
-	for {
-		offset, err := b.file.Seek(0, io.SeekCurrent)
+	for _, k := range keys {
+		e := b.index[k]
+		value, err := b.readValue(k, e)
 		if err != nil {
 			return err
 		}
+		if err := fn(k, e.vtype.text(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		var timestamp int64
-		if err := binary.Read(b.file, binary.LittleEndian, &timestamp); err != nil {
-			if err == io.EOF {
-				break
+// scanSequential reads the values of keys, which must be in file order,
+// with a single buffered pass over each data file.
+func (b *Bitcask) scanSequential(keys []string, fn func(key, value string) error) error {
+	var r *bufio.Reader
+	var pos int64
+	var seg uint32
+	for _, k := range keys {
+		e := b.index[k]
+		if r == nil || e.seg != seg {
+			end := b.end
+			if e.seg != 0 {
+				end = math.MaxInt64 // sealed segments do not grow
 			}
-			return err
+			r = bufio.NewReaderSize(io.NewSectionReader(b.segmentFile(e.seg), 0, end), b.opts.ScanBufferSize)
+			pos, seg = 0, e.seg
 		}
 
-		var keySize, valueSize uint32
-		if err := binary.Read(b.file, binary.LittleEndian, &keySize); err != nil {
+		// Skip stale records, then read this one whole so its checksum
+		// can be verified.
+		if _, err := io.CopyN(io.Discard, r, e.offset-pos); err != nil {
 			return err
 		}
-		if err := binary.Read(b.file, binary.LittleEndian, &valueSize); err != nil {
+		record := make([]byte, b.format.recordSize(len(k), e.valueSize))
+		if _, err := io.ReadFull(r, record); err != nil {
 			return err
 		}
+		pos = e.offset + int64(len(record))
 
-		keyBytes := make([]byte, keySize)
-		if _, err := io.ReadFull(b.file, keyBytes); err != nil {
+		value, err := b.format.keyedRecordValue(record, k, e.offset)
+		if err == nil && e.shared {
+			value, err = b.resolveShared(e.seg, value)
+		}
+		if err == nil && e.packed() {
+			value, err = b.unpack(k, value, e.flags())
+		}
+		if err == nil && e.meta {
+			value, err = stripMeta(value)
+		}
+		if err != nil {
 			return err
 		}
-
-		if _, err := b.file.Seek(int64(valueSize), io.SeekCurrent); err != nil {
+		if err := fn(k, e.vtype.text(value)); err != nil {
 			return err
 		}
+	}
+	return nil
+}
+
+// KeysByInsertionOrder returns all keys ordered by the file offset of
+// their latest record, i.e. by when each key was last written. Compaction
+// keeps this order unless CompactSorted is set.
+func (b *Bitcask) KeysByInsertionOrder() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.keysByOffset()
+}
 
-		b.index[string(keyBytes)] = offset
+// keysByOffset returns the indexed keys that have not expired, in file
+// order: sealed segments first, oldest first, then the active file.
+func (b *Bitcask) keysByOffset() []string {
+	now := b.now().UnixNano()
+	keys := make([]string, 0, len(b.index))
+	for k, e := range b.index {
+		if !e.expired(now) {
+			keys = append(keys, k)
+		}
 	}
+	sort.Slice(keys, func(i, j int) bool {
+		ei, ej := b.index[keys[i]], b.index[keys[j]]
+		if ei.seg != ej.seg {
+			return ei.fileOrder() < ej.fileOrder()
+		}
+		return ei.offset < ej.offset
+	})
+	return keys
+}
 
-	return nil
+// EstimateReclaim returns the number of bytes a compaction would free right
+// now: the current file size minus the size of every live record. It only
+// consults the index and file metadata, so it is cheap enough for a
+// scheduler to call before deciding whether to compact.
+func (b *Bitcask) EstimateReclaim() (int64, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.reclaimable()
 }
 
-// Compact creates a new file with only the latest value for each key.
-func (b *Bitcask) Compact() error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
+// DeadBytes returns the bytes taken up by stale records: overwritten and
+// deleted values, tombstones and expired keys. Unlike EstimateReclaim it
+// is kept up to date as writes happen, so it costs nothing to call. Load
+// initialises it from the file and compaction resets it. See
+// Options.AutoCompactThreshold.
+func (b *Bitcask) DeadBytes() int64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.dead
+}
 
-	tempPath := b.path + ".tmp"
-	tempFile, err := os.OpenFile(tempPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
+// maybeCompact starts a compaction in the background if the share of dead
+// bytes has reached AutoCompactThreshold and none is running. The caller
+// holds the write lock.
+func (b *Bitcask) maybeCompact() {
+	if b.opts.AutoCompactThreshold <= 0 || b.dead < autoCompactMinDead {
+		return
+	}
+	total := b.end + b.segmentsSize()
+	if float64(b.dead) < b.opts.AutoCompactThreshold*float64(total) {
+		return
+	}
+	if !b.compacting.CompareAndSwap(false, true) {
+		return
 	}
 
-	newIndex := make(map[string]int64)
+	b.merging.Add(1)
+	go func() {
+		defer b.merging.Done()
+		defer b.compacting.Store(false)
 
-	for key, oldOffset := range b.index {
-		if _, err := b.file.Seek(oldOffset, io.SeekStart); err != nil {
-			tempFile.Close()
-			os.Remove(tempPath)
-			return err
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, err := b.compact(context.Background()); err != nil {
+			b.logf("atomkv: %s: automatic compaction: %v", b.path, err)
 		}
+	}()
+}
 
-		var timestamp int64
-		var keySize, valueSize uint32
-		binary.Read(b.file, binary.LittleEndian, &timestamp)
-		binary.Read(b.file, binary.LittleEndian, &keySize)
-		binary.Read(b.file, binary.LittleEndian, &valueSize)
+func (b *Bitcask) reclaimable() (int64, error) {
+	if err := b.flushWrites(); err != nil {
+		return 0, err
+	}
+	info, err := b.src.Stat()
+	if err != nil {
+		return 0, err
+	}
 
-		b.file.Seek(int64(keySize), io.SeekCurrent)
-		valueBytes := make([]byte, valueSize)
-		io.ReadFull(b.file, valueBytes)
+	now := b.now().UnixNano()
+	live := b.format.dataStart * int64(1+len(b.segments))
+	for key, e := range b.index {
+		if !e.expired(now) {
+			live += b.format.recordSize(len(key), e.valueSize)
+		}
+	}
+	return info.Size() + b.segmentsSize() - live, nil
+}
 
-		newOffset, _ := tempFile.Seek(0, io.SeekEnd)
-		binary.Write(tempFile, binary.LittleEndian, timestamp)
-		binary.Write(tempFile, binary.LittleEndian, uint32(len(key)))
-		binary.Write(tempFile, binary.LittleEndian, valueSize)
-		tempFile.Write([]byte(key))
-		tempFile.Write(valueBytes)
+// Stats returns a snapshot of the database's size and state. It only
+// consults the index and file metadata.
+func (b *Bitcask) Stats() (Stats, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-		newIndex[key] = newOffset
+	if err := b.flushWrites(); err != nil {
+		return Stats{}, err
+	}
+	info, err := b.src.Stat()
+	if err != nil {
+		return Stats{}, err
+	}
+	reclaim, err := b.reclaimable()
+	if err != nil {
+		return Stats{}, err
 	}
 
-	b.file.Close()
-	tempFile.Close()
+	st := Stats{
+		Records:        b.records,
+		FileSize:       info.Size() + b.segmentsSize(),
+		Reclaimable:    reclaim,
+		Generation:     b.generation,
+		Sets:           b.sets.Load(),
+		Gets:           b.gets.Load(),
+		Deletes:        b.deletes.Load(),
+		LastCompaction: b.lastCompaction,
+	}
+	now := b.now().UnixNano()
+	for key, e := range b.index {
+		if e.expired(now) {
+			continue
+		}
+		st.Keys++
+		size := int64(e.valueSize)
+		if st.LargestValueKey == "" || size > st.LargestValueSize ||
+			(size == st.LargestValueSize && key < st.LargestValueKey) {
+			st.LargestValueKey, st.LargestValueSize = key, size
+		}
+	}
+	return st, nil
+}
 
-	if err := os.Rename(tempPath, b.path); err != nil {
-		return err
+// LogSize returns the offset just past the last record in the data file.
+// A change-data-capture consumer can remember it and later read the
+// records appended beyond it.
+//
+// Compaction rewrites the file and renumbers every offset, so a position
+// saved before a compaction is meaningless afterwards. Save Generation
+// alongside it to detect that.
+func (b *Bitcask) LogSize() int64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.end
+}
+
+// Generation returns a counter that starts at 0 and increases every time
+// the data file is replaced, e.g. by a successful compaction or a Reset;
+// it never goes back. Offsets obtained from LogSize or KeyInfo are only
+// valid while the generation is unchanged; a consumer that sees a new
+// generation must resync.
+func (b *Bitcask) Generation() uint64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.generation
+}
+
+// nextGeneration records that the data file was replaced, which makes
+// offsets and pooled read descriptors from before stale. The caller holds
+// the write lock.
+func (b *Bitcask) nextGeneration() {
+	b.generation++
+	if b.readers != nil {
+		b.readers.drop()
 	}
+}
+
+// Reset empties the database in place: the data file is truncated to a
+// fresh header and the index and all counters, including Generation, start
+// over as if the file had just been created. It lets tests reuse one
+// handle across cases. Watch subscriptions stay open.
+func (b *Bitcask) Reset() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	newFile, err := os.OpenFile(b.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if b.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if err := b.closeSegments(true); err != nil {
+		return err
+	}
+	b.wbuf = b.wbuf[:0]
+	if err := b.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := removeHint(b.path); err != nil {
+		return err
+	}
+	format, err := readFileHeader(b.file, b.opts)
 	if err != nil {
 		return err
 	}
 
-	b.file = newFile
-	b.index = newIndex
+	b.format = format
+	b.setIndex(make(map[string]entry))
+	clear(b.masked)
+	b.records = 0
+	b.dead = 0
+	b.clock = 0
+	b.end = format.dataStart
+	b.nextGeneration()
+	b.writesSinceDiskCheck = 0
+	b.lastCompaction = time.Time{}
+	b.sets.Store(0)
+	b.gets.Store(0)
+	b.deletes.Store(0)
 	return nil
 }
 
-// Keys returns all keys in the database.
-func (b *Bitcask) Keys() []string {
+// Sync commits the data file to stable storage.
+func (b *Bitcask) Sync() error {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
+	return b.syncFile()
+}
 
-	keys := make([]string, 0, len(b.index))
-	for k := range b.index {
-		keys = append(keys, k)
+// syncFile fsyncs the data file and reports it to OnSlowSync if it took
+// longer than the configured threshold. Databases opened with OpenFS have
+// nothing to sync.
+func (b *Bitcask) syncFile() error {
+	if b.file == nil {
+		return nil
 	}
-	return keys
+	if err := b.flushWrites(); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := b.file.Sync()
+	if err == nil {
+		b.unsynced.Store(false)
+	}
+	if d := time.Since(start); b.opts.OnSlowSync != nil && d > b.opts.SlowSyncThreshold {
+		b.opts.OnSlowSync(d)
+	}
+	return err
 }
 
-// Close closes the database file.
+// Close closes the database file and ends all watch subscriptions. With
+// CompactOnClose set it first compacts the file, and returns any error from
+// that compaction. Unless SkipSyncOnClose is set it then fsyncs the file.
+// Read-only databases are never compacted or synced.
 func (b *Bitcask) Close() error {
+	// The expirer, syncer and hint writer take the lock, so stop them
+	// before acquiring it.
+	b.stopExpiring()
+	b.stopSyncing()
+	b.stopHintWriter()
+	b.merging.Wait()
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	return b.file.Close()
+
+	b.closeWatchers()
+
+	var compactErr error
+	if b.opts.CompactOnClose && !b.opts.ReadOnly {
+		compactErr = b.compactOnClose()
+	}
+
+	// A clean Close means the data is durable, not just handed to the
+	// page cache.
+	var syncErr error
+	if !b.opts.ReadOnly {
+		syncErr = b.flushWrites()
+	}
+	if syncErr == nil && !b.opts.ReadOnly && !b.opts.SkipSyncOnClose {
+		syncErr = b.syncFile()
+	}
+	if b.opts.HintOnClose && !b.opts.ReadOnly {
+		if err := b.writeHint(); err != nil {
+			b.logf("atomkv: %s: writing hint file: %v", b.path, err)
+		}
+	}
+
+	if b.readers != nil {
+		b.readers.close()
+	}
+	b.closeSegments(false)
+	err := b.src.Close()
+	if b.base != nil {
+		if baseErr := b.base.Close(); err == nil {
+			err = baseErr
+		}
+	}
+	if b.claim != "" {
+		if compactErr == nil && syncErr == nil && err == nil {
+			err = markClean(b.dirty)
+		} else if b.dirty != nil {
+			b.dirty.Close() // keep the marker, but let another writer own it
+		}
+		b.dirty = nil
+		releasePath(b.claim)
+		b.claim = ""
+	}
+	switch {
+	case compactErr != nil:
+		return compactErr
+	case syncErr != nil:
+		return syncErr
+	default:
+		return err
+	}
+}
+
+// compactOnClose compacts the file if that would reclaim at least
+// compactOnCloseMinReclaim bytes. It is skipped if a compaction is
+// already running.
+func (b *Bitcask) compactOnClose() error {
+	if !b.compacting.CompareAndSwap(false, true) {
+		return nil
+	}
+	defer b.compacting.Store(false)
+
+	n, err := b.reclaimable()
+	if err != nil {
+		return err
+	}
+	if n < compactOnCloseMinReclaim {
+		return nil
+	}
+
+	_, err = b.compact(context.Background())
+	return err
 }
@@ -0,0 +1,628 @@
+package atomkv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// openTestDB opens a database with opts in a fresh temporary directory and
+// closes it when the test ends. It returns the database and its path.
+func openTestDB(t *testing.T, opts Options) (*Bitcask, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "data.db")
+	db, err := OpenWithOptions(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, path
+}
+
+func TestCompactLargeValues(t *testing.T) {
+	// A copy buffer that does not divide the value size exercises the
+	// short final chunk.
+	db, path := openTestDB(t, Options{CompactBufferSize: 7})
+	big := strings.Repeat("x", 1<<20)
+	for _, suffix := range []string{"a", "b", "c"} {
+		if err := db.Set("big", big+suffix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Set("small", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *Bitcask) {
+		t.Helper()
+		if v, err := db.Get("big"); err != nil || v != big+"c" {
+			t.Fatalf("Get(big) = %d bytes, %v; want the last value", len(v), err)
+		}
+		if v, err := db.Get("small"); err != nil || v != "v" {
+			t.Fatalf("Get(small) = %q, %v; want %q", v, err, "v")
+		}
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if err := reopened.Load(); err != nil {
+		t.Fatal(err)
+	}
+	check(reopened)
+}
+
+func TestGetDuringLargeOverwrite(t *testing.T) {
+	// Get reads the old value at its absolute offset while Set appends
+	// the new one; a reader must see one value or the other, whole.
+	db, _ := openTestDB(t, Options{})
+	const size = 10 << 20
+	values := []string{strings.Repeat("a", size), strings.Repeat("b", size)}
+	if err := db.Set("big", values[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 1; i <= 20; i++ {
+			if err := db.Set("big", values[i%2]); err != nil {
+				done <- err
+				return
+			}
+			if err := db.Set("other", "x"); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for reads := 0; ; reads++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Logf("%d reads during the overwrites", reads)
+			return
+		default:
+		}
+		v, err := db.Get("big")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != values[0] && v != values[1] {
+			t.Fatal("Get returned bytes mixing two values")
+		}
+	}
+}
+
+func TestMaxKeys(t *testing.T) {
+	db, _ := openTestDB(t, Options{MaxKeys: 3})
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Set(key, "1"); err != nil {
+			t.Fatalf("Set(%q) up to the cap: %v", key, err)
+		}
+	}
+	if err := db.Set("d", "1"); !errors.Is(err, ErrMaxKeysReached) {
+		t.Fatalf("Set of a key past the cap = %v; want ErrMaxKeysReached", err)
+	}
+	if _, err := db.Get("d"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("rejected key: Get = %v; want ErrKeyNotFound", err)
+	}
+	if err := db.Set("a", "2"); err != nil {
+		t.Fatalf("overwrite at the cap: %v", err)
+	}
+	if err := db.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("d", "1"); err != nil {
+		t.Fatalf("Set after a delete freed a slot: %v", err)
+	}
+	if n := db.Len(); n != 3 {
+		t.Fatalf("Len() = %d; want 3", n)
+	}
+}
+
+func TestEmptyValue(t *testing.T) {
+	db, path := openTestDB(t, Options{})
+	if err := db.Set("empty", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("other", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(stage string, db *Bitcask) {
+		t.Helper()
+		if v, err := db.Get("empty"); err != nil || v != "" {
+			t.Fatalf("%s: Get = %q, %v; want an empty value", stage, v, err)
+		}
+		if !db.Exists("empty") {
+			t.Fatalf("%s: Exists = false", stage)
+		}
+	}
+	reopen := func() *Bitcask {
+		t.Helper()
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		reopened, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { reopened.Close() })
+		if err := reopened.Load(); err != nil {
+			t.Fatal(err)
+		}
+		return reopened
+	}
+
+	check("Set", db)
+	db = reopen()
+	check("Load", db)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check("Compact", db)
+	db = reopen()
+	check("Load after Compact", db)
+
+	// An empty value as the very last record of the file.
+	if err := db.Set("empty", ""); err != nil {
+		t.Fatal(err)
+	}
+	db = reopen()
+	check("Load with the empty value last", db)
+}
+
+func TestReset(t *testing.T) {
+	db, path := openTestDB(t, Options{PreloadValues: true})
+	sub := db.Subscribe("")
+	defer sub.Close()
+	for i := 0; i < 5; i++ {
+		if err := db.Set("a", fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("b", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	headerSize := db.format.dataStart
+	gen := db.Generation()
+
+	if err := db.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The generation moves on, so offsets from before the Reset are stale.
+	want := Stats{FileSize: headerSize, Generation: gen + 1}
+	if st != want {
+		t.Fatalf("Stats after Reset = %+v; want %+v", st, want)
+	}
+	if n := db.DeadBytes(); n != 0 {
+		t.Fatalf("DeadBytes() = %d; want 0", n)
+	}
+	if n := len(db.values); n != 0 {
+		t.Fatalf("%d preloaded values kept", n)
+	}
+	if _, err := db.Get("b"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get(b) = %v; want ErrKeyNotFound", err)
+	}
+
+	// The handle stays usable, subscriptions included, and the file
+	// holds only what was written after the Reset.
+	for len(sub.C) > 0 {
+		<-sub.C
+	}
+	if err := db.Set("c", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if ev := <-sub.C; ev.Key != "c" {
+		t.Fatalf("event for %q; want c", ev.Key)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if err := reopened.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := reopened.Keys(); len(keys) != 1 || keys[0] != "c" {
+		t.Fatalf("keys after reopening = %q; want [c]", keys)
+	}
+
+	// A pooled read descriptor opened before the Reset must not be used
+	// on the files that follow it, even where the same record offsets
+	// come round again.
+	pooled, _ := openTestDB(t, Options{ReadHandles: 1, MaxSegmentSize: 100})
+	pad := strings.Repeat("x", 100)
+	set := func(key, value string) {
+		t.Helper()
+		if err := pooled.Set(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("pad", pad)
+	set("b", "value-of-b") // seals the padded file; b starts the next one
+	if _, err := pooled.Get("b"); err != nil {
+		t.Fatal(err)
+	}
+	set("pad", pad)
+	set("z", "1")
+	if err := pooled.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	set("pad", pad)
+	set("b", "VALUE-OF-B")
+	if v, err := pooled.Get("b"); err != nil || v != "VALUE-OF-B" {
+		t.Fatalf("Get(b) with ReadHandles after Reset = %q, %v; want %q", v, err, "VALUE-OF-B")
+	}
+}
+
+func TestOversizedValues(t *testing.T) {
+	db, _ := openTestDB(t, Options{})
+
+	// Values too large for the record's 32-bit length field cannot be
+	// allocated in a test, so check the limit where Set applies it.
+	if err := db.checkSize("k", 1, math.MaxUint32); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("checkSize of a value that needs the tombstone length = %v; want ErrValueTooLarge", err)
+	}
+	if err := db.checkSize("k", 1, math.MaxUint32-1); err != nil {
+		t.Fatalf("checkSize of the largest value = %v; want nil", err)
+	}
+
+	db.opts.MaxValueSize = 3
+	size := db.LogSize()
+	if err := db.Set("k", "1234"); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Set over MaxValueSize = %v; want ErrValueTooLarge", err)
+	}
+	if err := db.WriteBatch(map[string]string{"a": "1", "k": "1234"}); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("WriteBatch over MaxValueSize = %v; want ErrValueTooLarge", err)
+	}
+	if got := db.LogSize(); got != size {
+		t.Fatalf("rejected writes grew the log from %d to %d bytes", size, got)
+	}
+	if db.Exists("a") || db.Exists("k") {
+		t.Fatal("rejected writes are visible")
+	}
+	if err := db.Set("k", "123"); err != nil {
+		t.Fatalf("Set at MaxValueSize = %v; want nil", err)
+	}
+}
+
+func TestDeadBytes(t *testing.T) {
+	db, path := openTestDB(t, Options{})
+	value := strings.Repeat("x", 100)
+	const sets = 100
+	for i := 0; i < sets; i++ {
+		if err := db.Set("k", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record := db.format.recordSize(len("k"), uint32(len(value)))
+	if got, want := db.DeadBytes(), (sets-1)*record; got != want {
+		t.Fatalf("DeadBytes() after %d sets of one key = %d; want %d", sets, got, want)
+	}
+
+	// A deleted key's record and its tombstone are both dead.
+	if err := db.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	want := (sets-1)*record + db.format.recordSize(1, 1) + db.format.recordSize(1, tombstone)
+	if got := db.DeadBytes(); got != want {
+		t.Fatalf("DeadBytes() after a delete = %d; want %d", got, want)
+	}
+	if est, err := db.EstimateReclaim(); err != nil || est != want {
+		t.Fatalf("EstimateReclaim() = %d, %v; want %d", est, err, want)
+	}
+
+	// Load recounts the same figure from the file.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.DeadBytes(); got != want {
+		t.Fatalf("DeadBytes() after Load = %d; want %d", got, want)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.DeadBytes(); got != 0 {
+		t.Fatalf("DeadBytes() after Compact = %d; want 0", got)
+	}
+}
+
+func TestAutoCompactThreshold(t *testing.T) {
+	db, _ := openTestDB(t, Options{AutoCompactThreshold: 0.5})
+	value := strings.Repeat("x", 100)
+	// Enough overwrites to pass autoCompactMinDead as well.
+	for i := 0; i < 1000; i++ {
+		if err := db.Set("k", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st, err := db.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !st.LastCompaction.IsZero() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no compaction after the dead bytes passed the threshold")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if v, err := db.Get("k"); err != nil || v != value {
+		t.Fatalf("Get after the automatic compaction = %d bytes, %v", len(v), err)
+	}
+}
+
+func TestCachedOffsetMatchesFileSize(t *testing.T) {
+	db, path := openTestDB(t, Options{})
+	check := func(db *Bitcask, after string) {
+		t.Helper()
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := db.LogSize(); got != info.Size() {
+			t.Fatalf("after %s: cached offset %d, file size %d", after, got, info.Size())
+		}
+	}
+
+	check(db, "Open")
+	for i := 0; i < 500; i++ {
+		if err := db.Set(fmt.Sprintf("k%d", i%50), strings.Repeat("v", i%17)); err != nil {
+			t.Fatal(err)
+		}
+		check(db, fmt.Sprintf("Set %d", i))
+	}
+	if err := db.Delete("k1"); err != nil {
+		t.Fatal(err)
+	}
+	check(db, "Delete")
+	if err := db.WriteBatch(map[string]string{"a": "1", "b": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	check(db, "WriteBatch")
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(db, "Compact")
+	if err := db.Set("x", "y"); err != nil {
+		t.Fatal(err)
+	}
+	check(db, "Set after Compact")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Load starts the offset after the last good record, so writes
+	// after a repaired torn tail are readable.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{1, 2, 3, 4, 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	repaired, err := OpenWithOptions(path, Options{RepairOnLoad: true, Logger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repaired.Close()
+	if err := repaired.Load(); err != nil {
+		t.Fatal(err)
+	}
+	check(repaired, "Load")
+	if err := repaired.Set("after", "torn"); err != nil {
+		t.Fatal(err)
+	}
+	check(repaired, "Set after Load")
+	if err := repaired.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if err := reopened.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := reopened.Get("after"); err != nil || v != "torn" {
+		t.Fatalf("Get(after) = %q, %v; want %q", v, err, "torn")
+	}
+}
+
+func TestConcurrentWritersAppend(t *testing.T) {
+	db, path := openTestDB(t, Options{})
+	const writers, perWriter = 8, 200
+
+	// Move the shared cursor while writes run: with O_APPEND every write
+	// still lands at the end of the file.
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				if err := db.Set(fmt.Sprintf("w%d-%d", w, i), fmt.Sprint(i)); err != nil {
+					t.Error(err)
+					return
+				}
+				if i%40 == 0 {
+					db.file.Seek(3, io.SeekStart)
+				}
+				if v, err := db.Get(fmt.Sprintf("w%d-%d", w, i)); err != nil || v != fmt.Sprint(i) {
+					t.Errorf("Get after Set = %q, %v; want %q", v, err, fmt.Sprint(i))
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if err := reopened.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if n := reopened.Len(); n != writers*perWriter {
+		t.Fatalf("Len() after reopening = %d; want %d", n, writers*perWriter)
+	}
+	for w := 0; w < writers; w++ {
+		key := fmt.Sprintf("w%d-%d", w, perWriter-1)
+		if v, err := reopened.Get(key); err != nil || v != fmt.Sprint(perWriter-1) {
+			t.Fatalf("Get(%s) = %q, %v", key, v, err)
+		}
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+	configs := map[string]Options{
+		"default":     {},
+		"buffered":    {WriteBufferSize: 4096},
+		"read pool":   {ReadHandles: 4},
+		"preload":     {PreloadValues: true},
+		"segments":    {MaxSegmentSize: 8 << 10, AutoCompactThreshold: 0.3, WriteBufferSize: 1024, ReadHandles: 2},
+		"compression": {VerifyReads: true, Compression: CompressionGzip},
+	}
+	const goroutines, ops, slots = 8, 1500, 20
+
+	for name, opts := range configs {
+		t.Run(name, func(t *testing.T) {
+			db, _ := openTestDB(t, opts)
+
+			// Each writer sets its keys and reads each one straight
+			// back; a reader per writer checks that no Get returns an
+			// older value than the writer's last acknowledged Set.
+			// Compactions move records underneath both.
+			var wg sync.WaitGroup
+			var failed atomic.Bool
+			acked := make([]atomic.Int64, goroutines)
+			compact := func(err error) {
+				if err != nil && !errors.Is(err, ErrCompactionInProgress) {
+					t.Error(err)
+					failed.Store(true)
+				}
+			}
+			for g := 0; g < goroutines; g++ {
+				wg.Add(2)
+				go func(g int) {
+					defer wg.Done()
+					for i := 1; i <= ops && !failed.Load(); i++ {
+						key := fmt.Sprintf("g%d-%d", g, i%slots)
+						value := fmt.Sprintf("%d:%s", i, strings.Repeat("p", i%90))
+						if err := db.Set(key, value); err != nil {
+							t.Error(err)
+							failed.Store(true)
+							return
+						}
+						acked[g].Store(int64(i))
+						if got, err := db.Get(key); err != nil || got != value {
+							t.Errorf("Get(%s) right after Set = %q, %v; want %q", key, got, err, value)
+							failed.Store(true)
+							return
+						}
+						if i%200 == 0 {
+							compact(db.Compact())
+						}
+						if i%150 == 0 {
+							compact(db.CompactAsync())
+							compact(db.Flush())
+						}
+					}
+				}(g)
+				go func(g int) {
+					defer wg.Done()
+					w := (g + 1) % goroutines
+					for i := 0; i < ops && !failed.Load(); i++ {
+						n := acked[w].Load()
+						if n == 0 {
+							continue
+						}
+						key := fmt.Sprintf("g%d-%d", w, n%slots)
+						got, err := db.Get(key)
+						if err != nil {
+							t.Errorf("Get(%s) after Set %d was acknowledged: %v", key, n, err)
+							failed.Store(true)
+							return
+						}
+						var seen int64
+						fmt.Sscanf(got, "%d:", &seen)
+						if seen < n {
+							t.Errorf("Get(%s) returned write %d after write %d was acknowledged", key, seen, n)
+							failed.Store(true)
+							return
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+		})
+	}
+}
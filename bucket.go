@@ -0,0 +1,96 @@
+package atomkv
+
+import (
+	"errors"
+	"strings"
+)
+
+// bucketSeparator ends a bucket name in the keys stored for the bucket.
+// A NUL byte keeps bucket keys apart from ordinary text keys.
+const bucketSeparator = "\x00"
+
+// Bucket is a namespace within a database: its methods work on keys as if
+// the bucket were a database of its own. A bucket's keys are stored as the
+// bucket name, a NUL byte and the key, so buckets share the data file,
+// compaction and every database-wide operation; ForEach, Keys and the like
+// on the database see the stored form. Bucket names must not contain a
+// NUL byte; Bitcask.Bucket rejects them.
+//
+// A Bucket is just a name and may be used concurrently, like the database
+// it belongs to.
+type Bucket struct {
+	b      *Bitcask
+	prefix string
+}
+
+// errBucketName is returned for a bucket name containing the separator.
+var errBucketName = errors.New("bucket name contains a NUL byte")
+
+// Bucket returns the bucket called name. Buckets need no creating: one
+// exists while it holds keys. A name containing a NUL byte is rejected,
+// since its keys would be indistinguishable from those of another bucket.
+func (b *Bitcask) Bucket(name string) (*Bucket, error) {
+	if strings.Contains(name, bucketSeparator) {
+		return nil, errBucketName
+	}
+	return &Bucket{b: b, prefix: name + bucketSeparator}, nil
+}
+
+// Name returns the bucket's name.
+func (bk *Bucket) Name() string {
+	return strings.TrimSuffix(bk.prefix, bucketSeparator)
+}
+
+// Set stores value under key in the bucket.
+func (bk *Bucket) Set(key, value string) error {
+	return bk.b.Set(bk.prefix+key, value)
+}
+
+// Get returns the value of key in the bucket, or ErrKeyNotFound.
+func (bk *Bucket) Get(key string) (string, error) {
+	return bk.b.Get(bk.prefix + key)
+}
+
+// Exists reports whether key is in the bucket.
+func (bk *Bucket) Exists(key string) bool {
+	return bk.b.Exists(bk.prefix + key)
+}
+
+// Delete removes key from the bucket. It returns ErrKeyNotFound if the key
+// does not exist.
+func (bk *Bucket) Delete(key string) error {
+	return bk.b.Delete(bk.prefix + key)
+}
+
+// Keys returns the bucket's keys in ascending order, without the bucket
+// name.
+func (bk *Bucket) Keys() []string {
+	keys := bk.b.Scan(bk.prefix)
+	for i, k := range keys {
+		keys[i] = k[len(bk.prefix):]
+	}
+	return keys
+}
+
+// BucketStats returns the number of live keys in the bucket called name and
+// the bytes their values take in the data file, after any compression or
+// encryption, for reporting usage per bucket. Like Stats it walks the
+// index, so it costs time in proportion to the whole database.
+func (b *Bitcask) BucketStats(name string) (keys int, bytes int64, err error) {
+	if strings.Contains(name, bucketSeparator) {
+		return 0, 0, errBucketName
+	}
+	prefix := name + bucketSeparator
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	now := b.now().UnixNano()
+	for key, e := range b.index {
+		if strings.HasPrefix(key, prefix) && !e.expired(now) {
+			keys++
+			bytes += int64(e.valueSize)
+		}
+	}
+	return keys, bytes, nil
+}
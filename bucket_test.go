@@ -0,0 +1,33 @@
+package atomkv
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBucketName(t *testing.T) {
+	db, _ := openTestDB(t, Options{})
+	if _, err := db.Bucket("a\x00b"); !errors.Is(err, errBucketName) {
+		t.Fatalf("Bucket with a NUL byte = %v; want errBucketName", err)
+	}
+	if _, _, err := db.BucketStats("a\x00b"); !errors.Is(err, errBucketName) {
+		t.Fatalf("BucketStats with a NUL byte = %v; want errBucketName", err)
+	}
+
+	a, err := db.Bucket("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Name() != "a" {
+		t.Fatalf("Name() = %q; want a", a.Name())
+	}
+	if err := a.Set("k", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := a.Get("k"); err != nil || v != "1" {
+		t.Fatalf("Get(k) = %q, %v; want 1", v, err)
+	}
+	if keys := a.Keys(); len(keys) != 1 || keys[0] != "k" {
+		t.Fatalf("Keys() = %q; want [k]", keys)
+	}
+}
@@ -0,0 +1,146 @@
+package atomkv
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"math/bits"
+)
+
+// ChecksumType selects the algorithm used to checksum records. It is fixed
+// when a file is created and recorded in the file header.
+type ChecksumType uint8
+
+const (
+	ChecksumCRC32C   ChecksumType = iota // CRC-32 (Castagnoli), hardware accelerated on most CPUs (default)
+	ChecksumCRC64                        // CRC-64 (ECMA)
+	ChecksumXXHash64                     // xxHash64, fast and 64 bits wide
+)
+
+var (
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+	crc64Table  = crc64.MakeTable(crc64.ECMA)
+)
+
+// checksummer accumulates a checksum. 32-bit algorithms are widened to 64
+// bits so every algorithm fits the same record field.
+type checksummer interface {
+	io.Writer
+	Sum64() uint64
+}
+
+// new returns an empty checksummer for c.
+func (c ChecksumType) new() checksummer {
+	switch c {
+	case ChecksumCRC64:
+		return crc64.New(crc64Table)
+	case ChecksumXXHash64:
+		return newXXHash64()
+	default:
+		return crc32Sum{crc32.New(crc32cTable)}
+	}
+}
+
+// sum returns the checksum of p.
+func (c ChecksumType) sum(p []byte) uint64 {
+	h := c.new()
+	h.Write(p)
+	return h.Sum64()
+}
+
+type crc32Sum struct{ hash.Hash32 }
+
+func (c crc32Sum) Sum64() uint64 { return uint64(c.Sum32()) }
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxHash64 is a streaming implementation of XXH64 with seed 0.
+type xxHash64 struct {
+	v     [4]uint64
+	total uint64
+	mem   [32]byte
+	n     int // bytes buffered in mem
+}
+
+func newXXHash64() *xxHash64 {
+	// The initial state wraps around, which constant arithmetic rejects.
+	p1, p2 := xxPrime1, xxPrime2
+	return &xxHash64{v: [4]uint64{p1 + p2, p2, 0, -p1}}
+}
+
+func (x *xxHash64) Write(p []byte) (int, error) {
+	written := len(p)
+	x.total += uint64(len(p))
+
+	if x.n > 0 {
+		c := copy(x.mem[x.n:], p)
+		x.n += c
+		p = p[c:]
+		if x.n < len(x.mem) {
+			return written, nil
+		}
+		x.stripe(x.mem[:])
+		x.n = 0
+	}
+	for len(p) >= len(x.mem) {
+		x.stripe(p[:32])
+		p = p[32:]
+	}
+	x.n = copy(x.mem[:], p)
+	return written, nil
+}
+
+func (x *xxHash64) stripe(p []byte) {
+	for i := range x.v {
+		x.v[i] = xxRound(x.v[i], binary.LittleEndian.Uint64(p[8*i:]))
+	}
+}
+
+func (x *xxHash64) Sum64() uint64 {
+	var h uint64
+	if x.total >= 32 {
+		h = bits.RotateLeft64(x.v[0], 1) + bits.RotateLeft64(x.v[1], 7) +
+			bits.RotateLeft64(x.v[2], 12) + bits.RotateLeft64(x.v[3], 18)
+		for _, v := range x.v {
+			h = (h^xxRound(0, v))*xxPrime1 + xxPrime4
+		}
+	} else {
+		h = xxPrime5
+	}
+	h += x.total
+
+	p := x.mem[:x.n]
+	for ; len(p) >= 8; p = p[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(p))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(p) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(p)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		p = p[4:]
+	}
+	for _, c := range p {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	return bits.RotateLeft64(acc, 31) * xxPrime1
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"math/rand"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,11 +14,35 @@ import (
 )
 
 const (
-	numGoroutines = 10
-	totalOps      = 100000
+	blobOps = 20000
+	syncOps = 2000
+)
+
+// Workload shape, set from flags.
+var (
+	numGoroutines int
+	totalOps      int
+	valueSize     int
 )
 
 func main() {
+	flag.IntVar(&numGoroutines, "goroutines", 10, "concurrent goroutines")
+	flag.IntVar(&totalOps, "ops", 100000, "operations per phase, split across the goroutines")
+	flag.IntVar(&valueSize, "value-size", 16, "size of written values in bytes")
+	readRatio := flag.Float64("read-ratio", 0.8, "share of operations that are reads in the mixed phase (0-1)")
+	flag.Parse()
+	if *readRatio < 0 || *readRatio > 1 {
+		fmt.Fprintln(os.Stderr, "error: -read-ratio must be between 0 and 1")
+		os.Exit(2)
+	}
+	if numGoroutines < 1 || totalOps < numGoroutines || valueSize < 0 {
+		fmt.Fprintln(os.Stderr, "error: need -goroutines >= 1, -ops >= -goroutines and -value-size >= 0")
+		os.Exit(2)
+	}
+	// Round down so every goroutine does the same number of operations.
+	totalOps -= totalOps % numGoroutines
+	value := strings.Repeat("v", valueSize)
+
 	os.Remove("bench.db")
 
 	db, err := atomkv.Open("bench.db")
@@ -27,60 +55,219 @@ func main() {
 		os.Remove("bench.db")
 	}()
 
-	opsPerGoroutine := totalOps / numGoroutines
-
-	fmt.Printf("Benchmark: %d goroutines, %d total writes\n", numGoroutines, totalOps)
+	fmt.Printf("Benchmark: %d goroutines, %d ops per phase, %d-byte values\n", numGoroutines, totalOps, valueSize)
 	fmt.Println("---")
 
 	// Write benchmark
-	var wg sync.WaitGroup
+	writeDuration, writeLat := runConcurrent(func(id, i int) {
+		if err := db.Set(fmt.Sprintf("key-%d-%d", id, i), value); err != nil {
+			fmt.Fprintf(os.Stderr, "write error: %v\n", err)
+		}
+	})
+	fmt.Printf("Write: %d ops in %v\n", totalOps, writeDuration)
+	fmt.Printf("Write OPS: %.0f ops/sec\n", float64(totalOps)/writeDuration.Seconds())
+	printLatency("Write", writeLat)
+	fmt.Println("---")
+
+	// Concurrent read benchmark
+	readDuration, readLat := runConcurrent(func(id, i int) {
+		db.Get(fmt.Sprintf("key-%d-%d", id, i))
+	})
+	fmt.Printf("Read: %d ops in %v\n", totalOps, readDuration)
+	fmt.Printf("Read OPS: %.0f ops/sec\n", float64(totalOps)/readDuration.Seconds())
+	printLatency("Read", readLat)
+	benchPooledReads()
+	fmt.Println("---")
+
+	// Mixed: reads and writes interleaved in every goroutine
+	benchMixed(db, *readRatio, value)
+	fmt.Println("---")
+
+	// Full scan: one ReadAt per value vs. a buffered sequential pass
 	start := time.Now()
+	if err := db.ForEach(func(key, value string) error { return nil }); err != nil {
+		fmt.Fprintf(os.Stderr, "scan error: %v\n", err)
+	}
+	fmt.Printf("Scan (ReadAt): %d keys in %v\n", totalOps, time.Since(start))
 
-	for g := 0; g < numGoroutines; g++ {
-		wg.Add(1)
-		go func(id int) {
-			defer wg.Done()
-			for i := 0; i < opsPerGoroutine; i++ {
-				key := fmt.Sprintf("key-%d-%d", id, i)
-				value := fmt.Sprintf("value-%d-%d", id, i)
-				if err := db.Set(key, value); err != nil {
-					fmt.Fprintf(os.Stderr, "write error: %v\n", err)
-				}
-			}
-		}(g)
+	scanDB, err := atomkv.OpenWithOptions("bench.db", atomkv.Options{
+		ReadOnly:       true,
+		ScanBufferSize: 1 << 20,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := scanDB.Load(); err != nil {
+		fmt.Fprintf(os.Stderr, "error loading db: %v\n", err)
+		os.Exit(1)
+	}
+	start = time.Now()
+	if err := scanDB.ForEach(func(key, value string) error { return nil }); err != nil {
+		fmt.Fprintf(os.Stderr, "scan error: %v\n", err)
 	}
+	fmt.Printf("Scan (buffered): %d keys in %v\n", totalOps, time.Since(start))
+	scanDB.Close()
+	fmt.Println("---")
 
-	wg.Wait()
-	writeDuration := time.Since(start)
-	writeOPS := float64(totalOps) / writeDuration.Seconds()
+	// String vs. byte API on the same 1KB values
+	blob := make([]byte, 1024)
+	timeOps("Set (string)", func(i int) error { return db.Set(fmt.Sprintf("blob-%d", i), string(blob)) })
+	timeOps("SetBytes", func(i int) error { return db.SetBytes(fmt.Sprintf("blob-%d", i), blob) })
+	timeOps("Get (string)", func(i int) error {
+		_, err := db.Get(fmt.Sprintf("blob-%d", i))
+		return err
+	})
+	timeOps("GetBytes", func(i int) error {
+		_, err := db.GetBytes(fmt.Sprintf("blob-%d", i))
+		return err
+	})
+	fmt.Println("---")
 
-	fmt.Printf("Write: %d ops in %v\n", totalOps, writeDuration)
-	fmt.Printf("Write OPS: %.0f ops/sec\n", writeOPS)
+	// Durability: cost of fsync per write vs. periodic fsync vs. none
+	benchSync("Write (no fsync)", atomkv.Options{})
+	benchSync("Write (SyncInterval 10ms)", atomkv.Options{SyncInterval: 10 * time.Millisecond})
+	benchSync("Write (SyncOnWrite)", atomkv.Options{SyncOnWrite: true})
+	benchSync("Write (WriteBufferSize 64KB)", atomkv.Options{WriteBufferSize: 64 << 10})
+	benchSync("Write (EncryptionKey, AES-256)", atomkv.Options{EncryptionKey: make([]byte, 32)})
 	fmt.Println("---")
 
-	// Concurrent read benchmark
-	start = time.Now()
+	// File size
+	info, _ := os.Stat("bench.db")
+	fmt.Printf("File size: %.2f MB\n", float64(info.Size())/(1024*1024))
+}
+
+// timeOps runs fn for blobOps sequential operations and prints the rate.
+func timeOps(name string, fn func(i int) error) {
+	start := time.Now()
+	for i := 0; i < blobOps; i++ {
+		if err := fn(i); err != nil {
+			fmt.Fprintf(os.Stderr, "%s error: %v\n", name, err)
+			return
+		}
+	}
+	d := time.Since(start)
+	fmt.Printf("%s: %d ops in %v (%.0f ops/sec)\n", name, blobOps, d, float64(blobOps)/d.Seconds())
+}
+
+// benchSync times syncOps sequential writes to a scratch database opened
+// with opts.
+func benchSync(name string, opts atomkv.Options) {
+	os.Remove("bench-sync.db")
+	defer os.Remove("bench-sync.db")
+
+	db, err := atomkv.OpenWithOptions("bench-sync.db", opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return
+	}
+	defer db.Close()
+
+	start := time.Now()
+	for i := 0; i < syncOps; i++ {
+		if err := db.Set(fmt.Sprintf("key-%d", i), "value"); err != nil {
+			fmt.Fprintf(os.Stderr, "write error: %v\n", err)
+			return
+		}
+	}
+	d := time.Since(start)
+	fmt.Printf("%s: %d ops in %v (%.0f ops/sec)\n", name, syncOps, d, float64(syncOps)/d.Seconds())
+}
+
+// benchPooledReads repeats the concurrent read phase on a second handle
+// whose readers each get their own file descriptor.
+func benchPooledReads() {
+	db, err := atomkv.OpenWithOptions("bench.db", atomkv.Options{
+		ReadOnly:    true,
+		ReadHandles: numGoroutines,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return
+	}
+	defer db.Close()
+	if err := db.Load(); err != nil {
+		fmt.Fprintf(os.Stderr, "error loading db: %v\n", err)
+		return
+	}
+
+	d, _ := runConcurrent(func(id, i int) {
+		db.Get(fmt.Sprintf("key-%d-%d", id, i))
+	})
+	fmt.Printf("Read OPS (ReadHandles %d): %.0f ops/sec\n", numGoroutines, float64(totalOps)/d.Seconds())
+}
 
+// runConcurrent calls fn totalOps times, split evenly across
+// numGoroutines goroutines, with the goroutine's id and the operation's
+// index within it. It returns the elapsed time and every call's latency.
+func runConcurrent(fn func(id, i int)) (time.Duration, []time.Duration) {
+	opsPerGoroutine := totalOps / numGoroutines
+	lat := make([]time.Duration, totalOps)
+	var wg sync.WaitGroup
+	start := time.Now()
 	for g := 0; g < numGoroutines; g++ {
 		wg.Add(1)
 		go func(id int) {
 			defer wg.Done()
-			for i := 0; i < opsPerGoroutine; i++ {
-				key := fmt.Sprintf("key-%d-%d", id, i)
-				db.Get(key)
+			mine := lat[id*opsPerGoroutine : (id+1)*opsPerGoroutine]
+			for i := range mine {
+				opStart := time.Now()
+				fn(id, i)
+				mine[i] = time.Since(opStart)
 			}
 		}(g)
 	}
-
 	wg.Wait()
-	readDuration := time.Since(start)
-	readOPS := float64(totalOps) / readDuration.Seconds()
+	return time.Since(start), lat
+}
 
-	fmt.Printf("Read: %d ops in %v\n", totalOps, readDuration)
-	fmt.Printf("Read OPS: %.0f ops/sec\n", readOPS)
-	fmt.Println("---")
+// benchMixed runs goroutines that each interleave reads and writes of the
+// keys written by the write phase, readRatio of the operations reading,
+// and prints the combined rate and per-operation latencies. Which
+// operations read is random but the same on every run.
+func benchMixed(db *atomkv.Bitcask, readRatio float64, value string) {
+	// Decide every operation up front so the timed loop only does I/O.
+	opsPerGoroutine := totalOps / numGoroutines
+	isRead := make([]bool, totalOps)
+	rng := rand.New(rand.NewSource(1))
+	for i := range isRead {
+		isRead[i] = rng.Float64() < readRatio
+	}
 
-	// File size
-	info, _ := os.Stat("bench.db")
-	fmt.Printf("File size: %.2f MB\n", float64(info.Size())/(1024*1024))
+	d, lat := runConcurrent(func(id, i int) {
+		key := fmt.Sprintf("key-%d-%d", id, i)
+		if isRead[id*opsPerGoroutine+i] {
+			db.Get(key)
+		} else if err := db.Set(key, value); err != nil {
+			fmt.Fprintf(os.Stderr, "write error: %v\n", err)
+		}
+	})
+
+	var readLat, writeLat []time.Duration
+	for i, l := range lat {
+		if isRead[i] {
+			readLat = append(readLat, l)
+		} else {
+			writeLat = append(writeLat, l)
+		}
+	}
+
+	fmt.Printf("Mixed: %d goroutines, %d reads, %d writes in %v\n", numGoroutines, len(readLat), len(writeLat), d)
+	fmt.Printf("Mixed OPS: %.0f ops/sec\n", float64(totalOps)/d.Seconds())
+	printLatency("Read", readLat)
+	printLatency("Write", writeLat)
+}
+
+// printLatency prints the mean and tail latency of one operation type.
+func printLatency(name string, lat []time.Duration) {
+	if len(lat) == 0 {
+		return
+	}
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	var total time.Duration
+	for _, l := range lat {
+		total += l
+	}
+	fmt.Printf("%s latency: avg %v, p50 %v, p99 %v, max %v\n", name,
+		total/time.Duration(len(lat)), lat[len(lat)/2], lat[len(lat)*99/100], lat[len(lat)-1])
 }
@@ -1,46 +1,175 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"atomkv"
 )
 
 var db *atomkv.Bitcask
 
+// shuttingDown is closed when the server starts shutting down, so that
+// long-lived /watch streams end instead of holding Shutdown up.
+var shuttingDown = make(chan struct{})
+
+// defaultShutdownTimeout bounds how long shutdown waits for in-flight
+// requests; ATOMKV_SHUTDOWN_TIMEOUT overrides it.
+const defaultShutdownTimeout = 10 * time.Second
+
+// defaultKeysLimit caps /keys responses unless the request sets limit, so
+// a broad prefix cannot make the server build a huge response.
+const defaultKeysLimit = 1000
+
 type setRequest struct {
+	Key   string            `json:"key"`
+	Value string            `json:"value"`
+	Meta  map[string]string `json:"meta,omitempty"`
+}
+
+// watchKeepAlive is how often /watch sends a comment on an idle stream,
+// so proxies do not time the connection out.
+const watchKeepAlive = 15 * time.Second
+
+// watchEvent is the data of each /watch server-sent event.
+type watchEvent struct {
+	Key       string    `json:"key"`
+	Value     string    `json:"value,omitempty"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// metaHeaderPrefix prefixes the response headers /get uses for a key's
+// metadata.
+const metaHeaderPrefix = "X-Atomkv-Meta-"
+
+// incrRequest is the body of /incr; Delta defaults to 1.
+type incrRequest struct {
 	Key   string `json:"key"`
-	Value string `json:"value"`
+	Delta *int64 `json:"delta,omitempty"`
+}
+
+type multiDeleteResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// statsResponse is the body of /stats. Operation counts are since the
+// server started; LastCompaction is omitted until one has run.
+type statsResponse struct {
+	Keys           int        `json:"keys"`
+	Records        int64      `json:"records"`
+	FileSize       int64      `json:"file_size"`
+	Reclaimable    int64      `json:"reclaimable_bytes"`
+	Sets           uint64     `json:"sets"`
+	Gets           uint64     `json:"gets"`
+	Deletes        uint64     `json:"deletes"`
+	LastCompaction *time.Time `json:"last_compaction,omitempty"`
+}
+
+// bucketStatsResponse is the body of /stats?bucket=name.
+type bucketStatsResponse struct {
+	Bucket string `json:"bucket"`
+	Keys   int    `json:"keys"`
+	Bytes  int64  `json:"bytes"`
+}
+
+type recordResponse struct {
+	Key       string    `json:"key"`
+	Offset    int64     `json:"offset"`
+	Segment   uint32    `json:"segment"`
+	Size      int64     `json:"size"`
+	ValueSize int64     `json:"value_size"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
 func main() {
-	port := "8080"
-	if len(os.Args) > 1 {
-		port = os.Args[1]
+	port := flag.String("port", "8080", "port to listen on")
+	dbPath := flag.String("db", envOr("ATOMKV_PATH", "atomkv.db"), "database file")
+	flag.Parse()
+	// A bare port argument, the original interface, still works.
+	if flag.NArg() > 0 {
+		*port = flag.Arg(0)
+	}
+
+	shutdownTimeout := defaultShutdownTimeout
+	if s := os.Getenv("ATOMKV_SHUTDOWN_TIMEOUT"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			log.Fatalf("ATOMKV_SHUTDOWN_TIMEOUT: %v", err)
+		}
+		shutdownTimeout = d
 	}
 
 	var err error
-	db, err = atomkv.Open("atomkv.db")
+	db, err = atomkv.Open(*dbPath)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
 
-	if err := db.Load(); err != nil {
+	// An interrupt also stops a long Load instead of waiting it out.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := db.LoadContext(ctx); err != nil {
+		db.Close()
 		log.Fatal(err)
 	}
 
+	go handleHangup()
+
 	http.HandleFunc("/set", handleSet)
 	http.HandleFunc("/get", handleGet)
+	http.HandleFunc("/mget", handleMultiGet)
+	http.HandleFunc("/delete", handleDelete)
 	http.HandleFunc("/keys", handleKeys)
 	http.HandleFunc("/compact", handleCompact)
+	http.HandleFunc("/stats", handleStats)
+	http.HandleFunc("/watch", handleWatch)
+	http.HandleFunc("/mdel", handleMultiDelete)
+	http.HandleFunc("/batch", handleBatch)
+	http.HandleFunc("/incr", handleIncr)
+
+	// Debug endpoints expose the storage layout, so they are opt-in.
+	if os.Getenv("ATOMKV_DEBUG") != "" {
+		http.HandleFunc("/debug/record", handleDebugRecord)
+	}
 
-	log.Printf("atomkv server listening on :%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	srv := &http.Server{Addr: ":" + *port}
+	srv.RegisterOnShutdown(func() { close(shuttingDown) })
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("atomkv server listening on :%s (%s)", *port, *dbPath)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		db.Close()
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	// Stop accepting connections and let in-flight requests finish, then
+	// close the database, which syncs it to disk.
+	log.Printf("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		log.Fatalf("closing database: %v", err)
+	}
 }
 
 func handleSet(w http.ResponseWriter, r *http.Request) {
@@ -55,7 +184,21 @@ func handleSet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := db.Set(req.Key, req.Value); err != nil {
+	var err error
+	if len(req.Meta) > 0 {
+		err = db.SetWithMeta(req.Key, req.Value, req.Meta)
+	} else {
+		err = db.Set(req.Key, req.Value)
+	}
+	if err != nil {
+		if errors.Is(err, atomkv.ErrValueTooLarge) || errors.Is(err, atomkv.ErrKeyTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, atomkv.ErrMaxKeysReached) || errors.Is(err, atomkv.ErrDiskFull) {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -76,26 +219,66 @@ func handleGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	val, err := db.Get(key)
+	val, meta, err := db.GetValueAndMeta(key)
 	if err != nil {
-		if err == atomkv.ErrKeyNotFound {
+		if errors.Is(err, atomkv.ErrKeyNotFound) {
 			http.Error(w, "key not found", http.StatusNotFound)
 			return
 		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	for k, v := range meta {
+		w.Header().Set(metaHeaderPrefix+k, v)
+	}
 
 	fmt.Fprint(w, val)
 }
 
+func handleDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "missing key parameter", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.Delete(key); err != nil {
+		if errors.Is(err, atomkv.ErrKeyNotFound) {
+			http.Error(w, "key not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprint(w, "OK")
+}
+
 func handleKeys(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	keys := db.Keys()
+	limit := defaultKeysLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	keys, truncated := db.KeysWithPrefix(r.URL.Query().Get("prefix"), limit)
+	if truncated {
+		w.Header().Set("X-Atomkv-Truncated", "true")
+	}
 	json.NewEncoder(w).Encode(keys)
 }
 
@@ -105,10 +288,274 @@ func handleCompact(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := db.Compact(); err != nil {
+	// A client that gives up cancels the compaction, which also frees
+	// the writes it was holding up.
+	if err := db.CompactContext(r.Context()); err != nil {
+		if errors.Is(err, atomkv.ErrCompactionInProgress) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprint(w, "OK")
+}
+
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.URL.Query().Has("bucket") {
+		name := r.URL.Query().Get("bucket")
+		keys, bytes, err := db.BucketStats(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(bucketStatsResponse{Bucket: name, Keys: keys, Bytes: bytes})
+		return
+	}
+
+	st, err := db.Stats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := statsResponse{
+		Keys:        st.Keys,
+		Records:     st.Records,
+		FileSize:    st.FileSize,
+		Reclaimable: st.Reclaimable,
+		Sets:        st.Sets,
+		Gets:        st.Gets,
+		Deletes:     st.Deletes,
+	}
+	if !st.LastCompaction.IsZero() {
+		resp.LastCompaction = &st.LastCompaction
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleWatch streams changes to keys starting with the prefix parameter
+// as server-sent events until the client disconnects. Like the Watch API
+// it is at-most-once: a client that falls behind misses events.
+func handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := db.Subscribe(r.URL.Query().Get("prefix"))
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-shuttingDown:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case ev, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(watchEvent{Key: ev.Key, Value: ev.Value, Deleted: ev.Deleted, Timestamp: ev.Timestamp})
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
+
+func handleMultiGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var keys []string
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	values, err := db.GetMulti(keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(values)
+}
+
+func handleMultiDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var keys []string
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	n, err := db.DeleteMulti(keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(multiDeleteResponse{Deleted: n})
+}
+
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var pairs map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&pairs); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.WriteBatch(pairs); err != nil {
+		if errors.Is(err, atomkv.ErrValueTooLarge) || errors.Is(err, atomkv.ErrKeyTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, atomkv.ErrMaxKeysReached) || errors.Is(err, atomkv.ErrDiskFull) {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	fmt.Fprint(w, "OK")
 }
+
+func handleIncr(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req incrRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if req.Key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+	delta := int64(1)
+	if req.Delta != nil {
+		delta = *req.Delta
+	}
+
+	n, err := db.Increment(req.Key, delta)
+	if err != nil {
+		switch err {
+		case atomkv.ErrNotInteger:
+			http.Error(w, err.Error(), http.StatusConflict)
+		case atomkv.ErrMaxKeysReached, atomkv.ErrDiskFull:
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	fmt.Fprint(w, n)
+}
+
+func handleDebugRecord(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "missing key parameter", http.StatusBadRequest)
+		return
+	}
+
+	info, err := db.KeyInfo(key)
+	if err != nil {
+		if errors.Is(err, atomkv.ErrKeyNotFound) {
+			http.Error(w, "key not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(recordResponse{
+		Key:       key,
+		Offset:    info.Offset,
+		Segment:   info.Segment,
+		Size:      info.Size,
+		ValueSize: info.ValueSize,
+		Timestamp: info.Timestamp,
+	})
+}
+
+// envOr returns the environment variable key, or def if it is unset or
+// empty.
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// handleHangup runs maintenance on SIGHUP: the data file is synced to disk
+// and then compacted, without restarting the process.
+func handleHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if err := db.Sync(); err != nil {
+			log.Printf("SIGHUP: sync failed: %v", err)
+			continue
+		}
+
+		res, err := db.CompactWithStats()
+		if errors.Is(err, atomkv.ErrCompactionInProgress) {
+			log.Printf("SIGHUP: compaction already in progress, skipping")
+			continue
+		}
+		if err != nil {
+			log.Printf("SIGHUP: compaction failed: %v", err)
+			continue
+		}
+
+		log.Printf("SIGHUP: compacted %d -> %d records, reclaimed %d bytes in %v",
+			res.RecordsBefore, res.RecordsAfter, res.BytesBefore-res.BytesAfter, res.Duration)
+	}
+}
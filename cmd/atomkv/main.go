@@ -1,64 +1,295 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"atomkv"
 )
 
-const dbPath = "atomkv.db"
+// defaultDBPath is the database used when neither -db nor ATOMKV_PATH is
+// given.
+const defaultDBPath = "atomkv.db"
+
+// readOnlyCommands open the database read-only, so they can run alongside
+// a writer such as atomkv-server without touching its file.
+var readOnlyCommands = map[string]bool{
+	"get":    true,
+	"keys":   true,
+	"stats":  true,
+	"export": true,
+	"watch":  true,
+}
 
 func main() {
-	if len(os.Args) < 2 {
+	os.Exit(run())
+}
+
+// run carries out the command line and returns the exit status. It returns
+// instead of exiting so that the deferred Close still syncs the file and
+// removes the clean-shutdown marker when a command fails.
+func run() (code int) {
+	dbPath := flag.String("db", envOr("ATOMKV_PATH", defaultDBPath), "database file")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
 		usage()
-		os.Exit(1)
+		return 1
 	}
 
-	db, err := atomkv.Open(dbPath)
+	// A read-only handle also loads past a record the writer is still
+	// appending instead of failing on it.
+	readOnly := readOnlyCommands[args[0]]
+	db, err := atomkv.OpenWithOptions(*dbPath, atomkv.Options{ReadOnly: readOnly, RepairOnLoad: readOnly})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+		return 1
 	}
-	defer db.Close()
+	defer func() {
+		if err := db.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			code = 1
+		}
+	}()
 
 	if err := db.Load(); err != nil {
 		fmt.Fprintf(os.Stderr, "error loading db: %v\n", err)
-		os.Exit(1)
+		return 1
 	}
 
-	switch os.Args[1] {
+	switch args[0] {
 	case "set":
-		if len(os.Args) != 4 {
+		if len(args) != 3 {
 			fmt.Fprintln(os.Stderr, "usage: atomkv set <key> <value>")
-			os.Exit(1)
+			return 1
 		}
-		if err := db.Set(os.Args[2], os.Args[3]); err != nil {
+		if err := db.Set(args[1], args[2]); err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
-			os.Exit(1)
+			return 1
+		}
+		fmt.Println("OK")
+
+	case "mset":
+		if len(args) < 3 || len(args)%2 != 1 {
+			fmt.Fprintln(os.Stderr, "usage: atomkv mset <key> <value> [<key> <value> ...]")
+			return 1
+		}
+		pairs := make(map[string]string)
+		for i := 1; i < len(args); i += 2 {
+			pairs[args[i]] = args[i+1]
+		}
+		if err := db.WriteBatch(pairs); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
 		}
 		fmt.Println("OK")
 
 	case "get":
-		if len(os.Args) != 3 {
+		if len(args) != 2 {
 			fmt.Fprintln(os.Stderr, "usage: atomkv get <key>")
-			os.Exit(1)
+			return 1
 		}
-		val, err := db.Get(os.Args[2])
+		val, err := db.Get(args[1])
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
-			os.Exit(1)
+			return 1
 		}
 		fmt.Println(val)
 
+	case "delete":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: atomkv delete <key>")
+			return 1
+		}
+		if err := db.Delete(args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		fmt.Println("OK")
+
+	case "keys":
+		if len(args) > 2 {
+			fmt.Fprintln(os.Stderr, "usage: atomkv keys [prefix]")
+			return 1
+		}
+		prefix := ""
+		if len(args) == 2 {
+			prefix = args[1]
+		}
+		for _, key := range db.Scan(prefix) {
+			fmt.Println(key)
+		}
+
+	case "compact":
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "usage: atomkv compact")
+			return 1
+		}
+		res, err := db.CompactWithStats()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		fmt.Printf("OK: %s -> %s\n", formatBytes(res.BytesBefore), formatBytes(res.BytesAfter))
+
+	case "stats":
+		st, err := db.Stats()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		unique, total, err := db.DuplicateStats()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		fmt.Printf("keys:           %d\n", st.Keys)
+		fmt.Printf("file size:      %s\n", formatBytes(st.FileSize))
+		fmt.Printf("reclaimable:    %s\n", formatBytes(st.Reclaimable))
+		if st.Keys > 0 {
+			fmt.Printf("largest value:  %s (%s)\n", st.LargestValueKey, formatBytes(st.LargestValueSize))
+		}
+		fmt.Printf("records:        %d\n", total)
+		fmt.Printf("duplicates:     %d (%.1f%%)\n", total-unique, percent(total-unique, total))
+
+	case "export":
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "usage: atomkv export > dump.jsonl")
+			return 1
+		}
+		if err := db.ExportJSON(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+
+	case "import":
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "usage: atomkv import < dump.jsonl")
+			return 1
+		}
+		if err := db.ImportJSON(os.Stdin); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		fmt.Println("OK")
+
+	case "repl":
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "usage: atomkv repl")
+			return 1
+		}
+		if err := repl(db, os.Stdin, os.Stdout, isTerminal(os.Stdin)); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+
+	case "watch":
+		if len(args) > 2 {
+			fmt.Fprintln(os.Stderr, "usage: atomkv watch [prefix]")
+			return 1
+		}
+		prefix := ""
+		if len(args) == 2 {
+			prefix = args[1]
+		}
+		if err := watch(db, prefix); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+
 	default:
 		usage()
-		os.Exit(1)
+		return 1
 	}
+	return 0
 }
 
 func usage() {
-	fmt.Fprintln(os.Stderr, "usage: atomkv <command> [args]")
+	fmt.Fprintln(os.Stderr, "usage: atomkv [-db path] <command> [args]")
+	fmt.Fprintln(os.Stderr, "  -db path           Database file (default $ATOMKV_PATH, else atomkv.db)")
 	fmt.Fprintln(os.Stderr, "  set <key> <value>  Store a key-value pair")
+	fmt.Fprintln(os.Stderr, "  mset <k> <v> ...   Store several pairs atomically")
 	fmt.Fprintln(os.Stderr, "  get <key>          Retrieve a value by key")
+	fmt.Fprintln(os.Stderr, "  delete <key>       Remove a key")
+	fmt.Fprintln(os.Stderr, "  keys [prefix]      List keys, sorted, one per line")
+	fmt.Fprintln(os.Stderr, "  compact            Rewrite the file without stale records")
+	fmt.Fprintln(os.Stderr, "  stats              Show database size and health")
+	fmt.Fprintln(os.Stderr, "  export             Write all pairs to stdout as JSON lines")
+	fmt.Fprintln(os.Stderr, "  import             Set the pairs read from stdin as JSON lines")
+	fmt.Fprintln(os.Stderr, "  watch [prefix]     Print writes as they are appended")
+	fmt.Fprintln(os.Stderr, "  repl               Read commands from stdin with the database kept open")
+}
+
+// watchInterval is how often watch polls the data file for new records.
+const watchInterval = 200 * time.Millisecond
+
+// watch tails the data file and prints a line for every record appended
+// from now on, including writes by other processes. It runs until killed.
+func watch(db *atomkv.Bitcask, prefix string) error {
+	show := func(ev atomkv.Event) error {
+		if !strings.HasPrefix(ev.Key, prefix) {
+			return nil
+		}
+		if ev.Deleted {
+			fmt.Printf("DEL %s\n", ev.Key)
+		} else {
+			fmt.Printf("SET %s\n", ev.Key)
+		}
+		return nil
+	}
+
+	offset := db.LogSize()
+	for {
+		var err error
+		if offset, err = db.Changes(offset, show); err != nil {
+			return err
+		}
+
+		// When the writer compacts or starts a new segment, the file read
+		// above has been replaced and Refresh moves to the new one, whose
+		// offsets start over. Watching resumes at its end, so writes that
+		// reached it before this poll are not printed.
+		gen := db.Generation()
+		if err := db.Refresh(); err != nil {
+			return err
+		}
+		if db.Generation() != gen {
+			offset = db.LogSize()
+		}
+		time.Sleep(watchInterval)
+	}
+}
+
+// envOr returns the environment variable key, or def if it is unset or
+// empty.
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func percent(part, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(total)
+}
+
+// formatBytes renders n with a binary unit, e.g. "1.5 KiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
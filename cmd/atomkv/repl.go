@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"atomkv"
+)
+
+// repl reads commands from in, one per line, and runs them against db
+// until exit or the end of input. The database stays open and loaded
+// throughout, so commands cost no reload. A failed command prints its
+// error and the loop goes on.
+func repl(db *atomkv.Bitcask, in io.Reader, out io.Writer, prompt bool) error {
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for {
+		if prompt {
+			fmt.Fprint(out, "atomkv> ")
+		}
+		if !sc.Scan() {
+			if prompt {
+				fmt.Fprintln(out)
+			}
+			return sc.Err()
+		}
+		cmd, args, _ := strings.Cut(strings.TrimSpace(sc.Text()), " ")
+		if cmd == "exit" || cmd == "quit" {
+			return nil
+		}
+		if err := replCommand(db, out, cmd, strings.TrimSpace(args)); err != nil {
+			fmt.Fprintf(out, "error: %v\n", err)
+		}
+	}
+}
+
+// replCommand runs one REPL command. The value of set is the rest of the
+// line, so it may contain spaces.
+func replCommand(db *atomkv.Bitcask, out io.Writer, cmd, args string) error {
+	switch cmd {
+	case "":
+		return nil
+
+	case "set":
+		key, value, ok := strings.Cut(args, " ")
+		if !ok || key == "" {
+			return errors.New("usage: set <key> <value>")
+		}
+		if err := db.Set(key, value); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "OK")
+
+	case "get":
+		if args == "" || strings.Contains(args, " ") {
+			return errors.New("usage: get <key>")
+		}
+		val, err := db.Get(args)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, val)
+
+	case "delete":
+		if args == "" || strings.Contains(args, " ") {
+			return errors.New("usage: delete <key>")
+		}
+		if err := db.Delete(args); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "OK")
+
+	case "keys":
+		if strings.Contains(args, " ") {
+			return errors.New("usage: keys [prefix]")
+		}
+		for _, key := range db.Scan(args) {
+			fmt.Fprintln(out, key)
+		}
+
+	case "compact":
+		res, err := db.CompactWithStats()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "OK: %s -> %s\n", formatBytes(res.BytesBefore), formatBytes(res.BytesAfter))
+
+	default:
+		return fmt.Errorf("unknown command %q (set, get, delete, keys, compact, exit)", cmd)
+	}
+	return nil
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,230 @@
+package atomkv
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// CompactProgress reports the state of a compaction started with
+// CompactAsync to Options.OnCompactProgress.
+type CompactProgress struct {
+	Segments int // sealed segments being merged
+	Merged   int // segments copied so far
+
+	// Done is set in the last report. Err says why the compaction
+	// failed; if it is nil, Result describes what it reclaimed.
+	Done   bool
+	Err    error
+	Result CompactResult
+}
+
+// CompactAsync starts merging the sealed segments (see
+// Options.MaxSegmentSize) into one in the background and returns
+// immediately. Only the latest record of each key survives. Writes and
+// reads continue throughout: the active file is left alone, and the lock
+// is only taken briefly to snapshot the index and, at the end, to point
+// the merged keys at the new segment. Keys written in the meantime keep
+// their newer records.
+//
+// Progress is reported to Options.OnCompactProgress after each segment
+// and once more when the merge is done. It returns ErrReadOnly or
+// ErrCompactionInProgress if the merge cannot start; with no sealed
+// segments there is nothing to merge and it reports Done straight away.
+// Close waits for a running merge to finish.
+func (b *Bitcask) CompactAsync() error {
+	if b.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if !b.compacting.CompareAndSwap(false, true) {
+		return ErrCompactionInProgress
+	}
+
+	b.mu.RLock()
+	segs := append([]*segment(nil), b.segments...)
+	live := make(map[string]entry)
+	for k, e := range b.index {
+		if e.seg != 0 {
+			live[k] = e
+		}
+	}
+	masked := b.maskedKeys()
+	format := b.format
+	b.mu.RUnlock()
+
+	b.merging.Add(1)
+	go func() {
+		defer b.merging.Done()
+		defer b.compacting.Store(false)
+
+		res, err := b.mergeSegments(format, segs, live, masked)
+		b.reportCompact(CompactProgress{Segments: len(segs), Merged: len(segs), Done: true, Err: err, Result: res})
+	}()
+	return nil
+}
+
+func (b *Bitcask) reportCompact(p CompactProgress) {
+	if b.opts.OnCompactProgress != nil {
+		b.opts.OnCompactProgress(p)
+	}
+}
+
+// mergeSegments writes the records of segs that live still points at to a
+// new segment with the id of the newest one, then swaps it in. It runs
+// without the lock until the swap; sealed segments never change, so their
+// files can be read concurrently with writes.
+func (b *Bitcask) mergeSegments(format fileFormat, segs []*segment, live map[string]entry, masked []string) (CompactResult, error) {
+	start := time.Now()
+	if len(segs) == 0 {
+		return CompactResult{}, nil
+	}
+	last := segs[len(segs)-1]
+
+	// The merged file replaces every segment up to last, so its header
+	// marks the older ones as superseded in case a crash leaves them.
+	format.sealed = last.id - 1
+	tempPath := last.path + ".tmp"
+	out, err := os.OpenFile(tempPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, b.opts.FileMode)
+	if err != nil {
+		return CompactResult{}, err
+	}
+	fail := func(err error) (CompactResult, error) {
+		out.Close()
+		os.Remove(tempPath)
+		return CompactResult{}, err
+	}
+	if err := writeFileHeader(out, format); err != nil {
+		return fail(err)
+	}
+
+	type move struct {
+		key string
+		old entry
+		new entry
+	}
+	var moves []move
+	var result CompactResult
+	offset := format.dataStart
+	for i, s := range segs {
+		result.BytesBefore += s.size
+
+		// Find the live records of s in file order while counting them.
+		var keys []string
+		_, err := scanRecords(s.file, format, format.dataStart, s.size, func(off int64, h recordHeader, key []byte) error {
+			result.RecordsBefore++
+			if e, ok := live[string(key)]; ok && e.seg == s.id && e.offset == off {
+				keys = append(keys, string(key))
+			}
+			return nil
+		})
+		if err != nil && !damagedTail(err) {
+			return fail(err)
+		}
+		sort.Slice(keys, func(i, j int) bool { return live[keys[i]].offset < live[keys[j]].offset })
+
+		for _, k := range keys {
+			e := live[k]
+			record := make([]byte, format.recordSize(len(k), e.valueSize))
+			if _, err := s.file.ReadAt(record, e.offset); err != nil {
+				return fail(err)
+			}
+			if _, err := format.keyedRecordValue(record, k, e.offset); err != nil {
+				return fail(err)
+			}
+			ne := e
+			ne.seg, ne.offset = last.id, offset
+			// References point into the segment they were written to,
+			// so shared values are copied in full.
+			if e.shared {
+				ref, _ := format.recordValue(record, len(k))
+				r, err := decodeSharedRef(ref)
+				if err != nil {
+					return fail(err)
+				}
+				shared := make([]byte, format.recordSize(int(r.keySize), r.valueSize))
+				if _, err := s.file.ReadAt(shared, r.offset); err != nil {
+					return fail(err)
+				}
+				value, err := format.recordValue(shared, int(r.keySize))
+				if err != nil {
+					return fail(err)
+				}
+				record = format.encodeRecord(nil, e.timestamp, e.expiry, e.flags(), k, value, false)
+				ne.shared, ne.valueSize = false, uint32(len(value))
+			}
+			if _, err := out.Write(record); err != nil {
+				return fail(err)
+			}
+			offset += int64(len(record))
+			result.RecordsAfter++
+			moves = append(moves, move{key: k, old: e, new: ne})
+		}
+		if i < len(segs)-1 {
+			b.reportCompact(CompactProgress{Segments: len(segs), Merged: i + 1})
+		}
+	}
+	// Tombstones hiding base keys of a layered database must survive.
+	for _, k := range masked {
+		record := format.encodeRecord(nil, 0, 0, 0, k, nil, true)
+		if _, err := out.Write(record); err != nil {
+			return fail(err)
+		}
+		offset += int64(len(record))
+		result.RecordsAfter++
+	}
+	if err := out.Sync(); err != nil {
+		return fail(err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Reset, Close or a failed seal may have replaced the segments.
+	if len(b.segments) < len(segs) {
+		return fail(fmt.Errorf("segments changed during compaction"))
+	}
+	for i, s := range segs {
+		if b.segments[i] != s {
+			return fail(fmt.Errorf("segments changed during compaction"))
+		}
+	}
+
+	// A hint written before the swap would describe the old segment.
+	if err := removeHint(b.path); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tempPath, last.path); err != nil {
+		return fail(err)
+	}
+	merged := &segment{id: last.id, path: last.path, file: out, size: offset}
+
+	for _, m := range moves {
+		if e, ok := b.index[m.key]; ok && e == m.old {
+			b.index[m.key] = m.new
+		}
+	}
+	for _, s := range segs {
+		s.file.Close()
+		if s != last {
+			if err := os.Remove(s.path); err != nil {
+				b.logf("atomkv: %s: removing merged segment: %v", s.path, err)
+			}
+		}
+	}
+	b.segments = append([]*segment{merged}, b.segments[len(segs):]...)
+	b.records -= result.RecordsBefore - result.RecordsAfter
+	// Only the headers of the merged segments were not counted as dead.
+	reclaimed := result.BytesBefore - offset - int64(len(segs)-1)*format.dataStart
+	b.dead = max(b.dead-reclaimed, 0)
+	b.nextGeneration()
+	b.lastCompaction = b.now()
+
+	if err := b.writeHint(); err != nil {
+		b.logf("atomkv: %s: writing hint file: %v", b.path, err)
+	}
+
+	result.BytesAfter = offset
+	result.Duration = time.Since(start)
+	return result, nil
+}
@@ -0,0 +1,83 @@
+package atomkv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compression selects how Set compresses values before writing them.
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota // values are stored as written (default)
+	CompressionGzip                    // gzip at the default level
+)
+
+// A record with flagCompressed set stores its payload, metadata included,
+// compressed, prefixed with the codec that compressed it:
+//
+//	| codec (1B) | compressed payload |
+//
+// The value size in the record header covers both parts. Records without
+// the flag are read as before whatever Options.Compression says, so files
+// written with different settings mix freely.
+
+// minCompressSize is the smallest payload worth compressing; below it the
+// codec's framing costs more than it saves.
+const minCompressSize = 64
+
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// compress returns payload compressed with c and prefixed with its codec,
+// or ok false if c is CompressionNone or compressing would not make the
+// payload smaller.
+func compress(c Compression, payload []byte) (stored []byte, ok bool) {
+	if c == CompressionNone || len(payload) < minCompressSize {
+		return nil, false
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(byte(c))
+	switch c {
+	case CompressionGzip:
+		zw := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(zw)
+		zw.Reset(&buf)
+		zw.Write(payload)
+		if err := zw.Close(); err != nil {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	if buf.Len() >= len(payload) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// decompress reverses compress. A payload naming an unknown codec or
+// failing to decompress returns an error wrapping ErrCorruptRecord.
+func decompress(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, fmt.Errorf("%w: empty compressed value", ErrCorruptRecord)
+	}
+	switch Compression(stored[0]) {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(stored[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptRecord, err)
+		}
+		payload, err := io.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptRecord, err)
+		}
+		return payload, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown compression codec %d", ErrCorruptRecord, stored[0])
+	}
+}
@@ -0,0 +1,109 @@
+package atomkv
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompressionShrinksRecords(t *testing.T) {
+	db, path := openTestDB(t, Options{Compression: CompressionGzip})
+	doc := strings.Repeat(`{"name":"alice","role":"admin"},`, 200)
+	if err := db.Set("doc", doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("small", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := db.KeyInfo("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ValueSize >= int64(len(doc)) {
+		t.Fatalf("stored value is %d bytes; want fewer than the %d raw bytes", info.ValueSize, len(doc))
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() >= int64(len(doc)) {
+		t.Fatalf("file is %d bytes; want fewer than the %d raw bytes", fi.Size(), len(doc))
+	}
+	if v, err := db.Get("doc"); err != nil || v != doc {
+		t.Fatalf("Get(doc) = %d bytes, %v; want the original value", len(v), err)
+	}
+	if v, err := db.Get("small"); err != nil || v != "x" {
+		t.Fatalf("Get(small) = %q, %v; want %q", v, err, "x")
+	}
+}
+
+func TestCompressionMixedRecords(t *testing.T) {
+	doc := strings.Repeat("abcd", 1000)
+	path := filepath.Join(t.TempDir(), "data.db")
+
+	// Records written without compression stay readable once it is
+	// turned on, and the other way round.
+	plain, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.Set("plain", doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	gz, err := OpenWithOptions(path, Options{Compression: CompressionGzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.SetWithMeta("packed", doc, map[string]string{"type": "text"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	var snap bytes.Buffer
+	if err := gz.Snapshot(&snap); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, db *Bitcask) {
+		t.Helper()
+		for _, key := range []string{"plain", "packed"} {
+			if v, err := db.Get(key); err != nil || v != doc {
+				t.Fatalf("%s: Get(%s) = %d bytes, %v; want the original value", name, key, len(v), err)
+			}
+		}
+		if meta, err := db.GetMeta("packed"); err != nil || meta["type"] != "text" {
+			t.Fatalf("%s: GetMeta(packed) = %v, %v", name, meta, err)
+		}
+	}
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Load(); err != nil {
+		t.Fatal(err)
+	}
+	check("reopened", db)
+
+	restored, err := OpenFromSnapshot(filepath.Join(t.TempDir(), "restored.db"), &snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	check("snapshot", restored)
+}
@@ -0,0 +1,141 @@
+package atomkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Value deduplication (Options.CompactDedupValues) lets compaction store a
+// value once and give every other key holding the same bytes a shared
+// record. A shared record has flagShared set and, as its value, a reference
+// to the record holding the bytes:
+//
+//	| record offset (8B) | key size (4B) | value size (4B) |
+//
+// The referenced record is an ordinary record earlier in the same file, so
+// its checksum covers the shared bytes. References only ever point at
+// records written by the same compaction, and the next compaction resolves
+// them again, so an overwritten key never invalidates them.
+
+// sharedRefSize is the size of a shared record's value.
+const sharedRefSize = 16
+
+// sharedRef is a decoded shared record value.
+type sharedRef struct {
+	offset    int64
+	keySize   uint32
+	valueSize uint32
+}
+
+func encodeSharedRef(r sharedRef) []byte {
+	p := make([]byte, sharedRefSize)
+	binary.LittleEndian.PutUint64(p[0:8], uint64(r.offset))
+	binary.LittleEndian.PutUint32(p[8:12], r.keySize)
+	binary.LittleEndian.PutUint32(p[12:16], r.valueSize)
+	return p
+}
+
+func decodeSharedRef(p []byte) (sharedRef, error) {
+	if len(p) != sharedRefSize {
+		return sharedRef{}, ErrCorruptRecord
+	}
+	return sharedRef{
+		offset:    int64(binary.LittleEndian.Uint64(p[0:8])),
+		keySize:   binary.LittleEndian.Uint32(p[8:12]),
+		valueSize: binary.LittleEndian.Uint32(p[12:16]),
+	}, nil
+}
+
+// resolveShared returns the value a shared record's value refers to. The
+// referenced record is in the same segment, seg, as the shared record.
+func (b *Bitcask) resolveShared(seg uint32, ref []byte) ([]byte, error) {
+	r, err := decodeSharedRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	return b.readRecordValue(seg, r.offset, int(r.keySize), r.valueSize)
+}
+
+// valueLocation returns where the bytes of key's value are in the file
+// holding its record, following the reference of a shared record.
+func (b *Bitcask) valueLocation(key string, e entry) (offset int64, size uint32, err error) {
+	if !e.shared {
+		return e.offset + b.format.recordHeaderSize() + int64(len(key)), e.valueSize, nil
+	}
+	ref, err := b.readRecordValue(e.seg, e.offset, len(key), e.valueSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	r, err := decodeSharedRef(ref)
+	if err != nil {
+		return 0, 0, err
+	}
+	return r.offset + b.format.recordHeaderSize() + int64(r.keySize), r.valueSize, nil
+}
+
+// dedupKey identifies candidate duplicates; equal keys are confirmed by
+// comparing the bytes.
+type dedupKey struct {
+	sum   uint64
+	size  uint32
+	vtype valueType
+}
+
+// dedupTable tracks the values a compaction has written to the new file.
+type dedupTable struct {
+	format  fileFormat
+	maxSize int
+	seen    map[dedupKey]sharedRef
+	scratch []byte
+}
+
+func newDedupTable(format fileFormat, maxSize int) *dedupTable {
+	return &dedupTable{
+		format:  format,
+		maxSize: maxSize,
+		seen:    make(map[dedupKey]sharedRef),
+	}
+}
+
+// eligible reports whether a value of the given size is worth sharing: it
+// must be larger than a reference and fit the compaction buffer.
+func (t *dedupTable) eligible(size uint32) bool {
+	return size > sharedRefSize && int(size) <= t.maxSize
+}
+
+func (t *dedupTable) key(value []byte, vt valueType) dedupKey {
+	h := newXXHash64()
+	h.Write(value)
+	return dedupKey{sum: h.Sum64(), size: uint32(len(value)), vtype: vt}
+}
+
+// find looks for a copy of value already written to dst and returns an
+// encoded reference to it.
+func (t *dedupTable) find(dst io.ReaderAt, value []byte, vt valueType) (ref []byte, found bool, err error) {
+	r, ok := t.seen[t.key(value, vt)]
+	if !ok {
+		return nil, false, nil
+	}
+	if cap(t.scratch) < len(value) {
+		t.scratch = make([]byte, len(value))
+	}
+	existing := t.scratch[:len(value)]
+	offset := r.offset + t.format.recordHeaderSize() + int64(r.keySize)
+	if _, err := dst.ReadAt(existing, offset); err != nil {
+		return nil, false, err
+	}
+	if !bytes.Equal(existing, value) {
+		return nil, false, nil
+	}
+	return encodeSharedRef(r), true, nil
+}
+
+// add records that value was written to dst in the record at offset.
+func (t *dedupTable) add(value []byte, vt valueType, offset int64, keySize int) {
+	t.seen[t.key(value, vt)] = sharedRef{
+		offset:    offset,
+		keySize:   uint32(keySize),
+		valueSize: uint32(len(value)),
+	}
+}
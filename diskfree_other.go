@@ -0,0 +1,9 @@
+//go:build !(linux || darwin)
+
+package atomkv
+
+// freeDiskBytes reports that free space cannot be determined on this
+// platform, which disables the MinFreeDiskBytes check.
+func freeDiskBytes(path string) (uint64, bool, error) {
+	return 0, false, nil
+}
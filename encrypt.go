@@ -0,0 +1,93 @@
+package atomkv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// ErrDecryption is returned when an encrypted value cannot be decrypted,
+// most often because the database was opened with a different
+// EncryptionKey, or with none.
+var ErrDecryption = errors.New("cannot decrypt value; wrong or missing encryption key")
+
+// A record with flagEncrypted set stores its payload sealed with AES-GCM
+// under Options.EncryptionKey, after any compression:
+//
+//	| nonce (12B) | ciphertext | tag (16B) |
+//
+// Each record gets a fresh random nonce. The record's key is the
+// additional data, so a value copied onto another key fails to decrypt
+// rather than reading as that key's value. Keys themselves stay plaintext
+// because the index and every scan need them.
+
+// newAEAD returns the cipher for key, or nil if key is empty.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt seals payload for key with a fresh nonce.
+func (b *Bitcask) encrypt(key string, payload []byte) ([]byte, error) {
+	nonce := make([]byte, b.aead.NonceSize(), b.aead.NonceSize()+len(payload)+b.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return b.aead.Seal(nonce, nonce, payload, []byte(key)), nil
+}
+
+// decrypt reverses encrypt.
+func (b *Bitcask) decrypt(key string, stored []byte) ([]byte, error) {
+	if b.aead == nil || len(stored) < b.aead.NonceSize() {
+		return nil, ErrDecryption
+	}
+	n := b.aead.NonceSize()
+	payload, err := b.aead.Open(nil, stored[:n], stored[n:], []byte(key))
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	return payload, nil
+}
+
+// storedPayload returns the bytes to write for key's payload and their
+// record flags: the payload compressed if Options.Compression is set, then
+// encrypted if Options.EncryptionKey is. Files in formats without record
+// flags are written as they are.
+func (b *Bitcask) storedPayload(key string, payload []byte, flags uint8) ([]byte, uint8, error) {
+	if !b.format.hasFlags() {
+		return payload, flags, nil
+	}
+	if stored, ok := compress(b.opts.Compression, payload); ok {
+		payload, flags = stored, flags|flagCompressed
+	}
+	if b.aead != nil {
+		stored, err := b.encrypt(key, payload)
+		if err != nil {
+			return nil, 0, err
+		}
+		payload, flags = stored, flags|flagEncrypted
+	}
+	return payload, flags, nil
+}
+
+// unpack reverses storedPayload for a record of key with the given flags.
+func (b *Bitcask) unpack(key string, stored []byte, flags uint8) ([]byte, error) {
+	var err error
+	if flags&flagEncrypted != 0 {
+		if stored, err = b.decrypt(key, stored); err != nil {
+			return nil, err
+		}
+	}
+	if flags&flagCompressed != 0 {
+		return decompress(stored)
+	}
+	return stored, nil
+}
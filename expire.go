@@ -0,0 +1,152 @@
+package atomkv
+
+import "time"
+
+// expireRepeatRatio is the share of expired keys in a sample above which
+// the expirer samples again straight away rather than waiting for the next
+// tick.
+const expireRepeatRatio = 0.25
+
+// SetWithTTL writes a key-value pair that expires ttl from now. An expired
+// key reads as missing, is skipped by Load and dropped by compaction; set
+// Options.ExpireInterval to also reclaim its index slot in the background,
+// or call ExpireNow.
+// A ttl of zero or less means the key never expires, like Set.
+func (b *Bitcask) SetWithTTL(key, value string, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ttl <= 0 {
+		return b.set(key, []byte(value), typeString, 0, nil)
+	}
+	if !b.format.hasExpiry() {
+		return ErrUpgradeRequired
+	}
+	return b.set(key, []byte(value), typeString, b.now().Add(ttl).UnixNano(), nil)
+}
+
+// startExpirer launches the active expiration goroutine.
+func (b *Bitcask) startExpirer() {
+	b.stopExpire = make(chan struct{})
+	b.expireDone = make(chan struct{})
+
+	go func() {
+		defer close(b.expireDone)
+
+		ticker := time.NewTicker(b.opts.ExpireInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.stopExpire:
+				return
+			case <-ticker.C:
+				b.expireCycle()
+			}
+		}
+	}()
+}
+
+// stopExpiring stops the active expiration goroutine, if running, and
+// waits for it to exit. It is safe to call more than once.
+func (b *Bitcask) stopExpiring() {
+	if b.stopExpire == nil {
+		return
+	}
+	b.stopExpirer.Do(func() {
+		close(b.stopExpire)
+		<-b.expireDone
+	})
+}
+
+// expireCycle runs one round of active expiration in the style of Redis:
+// rather than sweeping the whole index it samples ExpireSampleSize keys
+// that have a TTL and drops those that expired. If more than a quarter of
+// the sample had expired, many more probably have, so it samples again.
+// A cycle stops after a quarter of ExpireInterval so the write lock, which
+// is only held per sample, is never monopolised. It returns the number of
+// keys removed.
+func (b *Bitcask) expireCycle() int {
+	deadline := time.Now().Add(b.opts.ExpireInterval / 4)
+
+	removed := 0
+	for {
+		expired, sampled := b.expireSample(b.opts.ExpireSampleSize)
+		removed += expired
+		if sampled == 0 || float64(expired) <= expireRepeatRatio*float64(sampled) {
+			return removed
+		}
+		if time.Now().After(deadline) {
+			return removed
+		}
+	}
+}
+
+// ExpireNow removes every expired key from the index and returns how many
+// it removed. Unlike the sampling of ExpireInterval it sweeps all keys
+// with a TTL, so afterwards none that has expired holds an index slot.
+// The sweep runs under the read lock; the removals take the write lock
+// for ExpireSampleSize keys at a time, so writes are not held up for a
+// large sweep.
+func (b *Bitcask) ExpireNow() int {
+	b.mu.RLock()
+	now := b.now().UnixNano()
+	var expired []string
+	for key := range b.ttlKeys {
+		if b.index[key].expired(now) {
+			expired = append(expired, key)
+		}
+	}
+	b.mu.RUnlock()
+
+	removed := 0
+	for len(expired) > 0 {
+		n := min(len(expired), b.opts.ExpireSampleSize)
+		removed += b.expireKeys(expired[:n])
+		expired = expired[n:]
+	}
+	return removed
+}
+
+// expireKeys removes those of keys that are still expired from the index
+// and returns how many it removed. A key may have been rewritten since it
+// was found expired, so each is checked again under the write lock.
+func (b *Bitcask) expireKeys(keys []string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	removed := 0
+	for _, key := range keys {
+		if e, ok := b.index[key]; ok && e.expired(now.UnixNano()) {
+			b.indexDelete(key)
+			removed++
+			b.publish(Event{Key: key, Deleted: true, Timestamp: now})
+		}
+	}
+	return removed
+}
+
+// expireSample examines up to n keys with a TTL and removes the expired
+// ones from the index. Map iteration order in Go is randomised, so the
+// first n keys visited form a cheap random sample.
+func (b *Bitcask) expireSample(n int) (expired, sampled int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	for key := range b.ttlKeys {
+		if sampled == n {
+			break
+		}
+		sampled++
+
+		if b.index[key].expired(now.UnixNano()) {
+			// The record on disk already carries its expiry, so no
+			// tombstone is needed for Load or compaction to drop it.
+			b.indexDelete(key)
+			expired++
+			b.publish(Event{Key: key, Deleted: true, Timestamp: now})
+		}
+	}
+	return expired, sampled
+}
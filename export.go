@@ -0,0 +1,86 @@
+package atomkv
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// jsonRecord is one line of the newline-delimited JSON that ExportJSON
+// writes. JSON strings can only hold UTF-8, so a pair whose key or value is
+// not valid UTF-8 has both base64-encoded and Encoding set to "base64".
+type jsonRecord struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+const jsonBase64 = "base64"
+
+// ExportJSON writes every live key and value to w as newline-delimited
+// JSON, one {"key": ..., "value": ...} object per line in file order.
+// Values are exported as Get returns them, so typed values become their
+// text form. Pairs are encoded one at a time, so memory use does not grow
+// with the size of the database. The read lock is held for the whole
+// export, as with ForEach.
+func (b *Bitcask) ExportJSON(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+
+	err := b.ForEach(func(key, value string) error {
+		rec := jsonRecord{Key: key, Value: value}
+		if !utf8.ValidString(key) || !utf8.ValidString(value) {
+			rec.Key = base64.StdEncoding.EncodeToString([]byte(key))
+			rec.Value = base64.StdEncoding.EncodeToString([]byte(value))
+			rec.Encoding = jsonBase64
+		}
+		return enc.Encode(rec)
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ImportJSON reads newline-delimited JSON in the form ExportJSON writes
+// and stores each pair with Set, one record at a time. Existing keys are
+// overwritten and other keys are left alone. It stops at the first
+// malformed record or failed write; the pairs before it stay imported.
+func (b *Bitcask) ImportJSON(r io.Reader) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for n := 1; ; n++ {
+		var rec jsonRecord
+		if err := dec.Decode(&rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+
+		key, value := rec.Key, rec.Value
+		switch rec.Encoding {
+		case "":
+		case jsonBase64:
+			k, err := base64.StdEncoding.DecodeString(rec.Key)
+			if err != nil {
+				return fmt.Errorf("record %d: key: %w", n, err)
+			}
+			v, err := base64.StdEncoding.DecodeString(rec.Value)
+			if err != nil {
+				return fmt.Errorf("record %d: value: %w", n, err)
+			}
+			key, value = string(k), string(v)
+		default:
+			return fmt.Errorf("record %d: unknown encoding %q", n, rec.Encoding)
+		}
+
+		if err := b.Set(key, value); err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+	}
+}
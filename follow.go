@@ -0,0 +1,109 @@
+package atomkv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+)
+
+// Refresh brings the index of a read-only database up to date with records
+// another process has appended since the last Load or Refresh. Calling it
+// periodically turns a read-only handle into a cheap follower of a writer
+// sharing the same file.
+//
+// When the writer compacts or resets the database, the file is replaced or
+// shrinks and every known offset becomes invalid. Refresh detects this,
+// reopens the path and rebuilds the index from scratch, incrementing
+// Generation. A record that is still being written is picked up by the next
+// call. Refresh returns ErrNotReadOnly on a writable database, whose index
+// is always current.
+func (b *Bitcask) Refresh() error {
+	if !b.opts.ReadOnly {
+		return ErrNotReadOnly
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	info, err := b.src.Stat()
+	if err != nil {
+		return err
+	}
+	replaced := info.Size() < b.end
+	if b.fsys == nil {
+		current, err := os.Stat(b.path)
+		if err != nil {
+			return err
+		}
+		replaced = replaced || !os.SameFile(info, current)
+	}
+	if replaced {
+		if err := b.reopen(); err != nil {
+			return err
+		}
+		if info, err = b.src.Stat(); err != nil {
+			return err
+		}
+	}
+
+	if b.end < b.format.dataStart {
+		b.end = b.format.dataStart
+	}
+	var changed []string
+	next, err := scanRecords(b.src, b.format, b.end, info.Size(), func(offset int64, h recordHeader, key []byte) error {
+		b.applyRecord(0, offset, h, key)
+		if b.values != nil {
+			changed = append(changed, string(key))
+		}
+		return nil
+	})
+	b.end = next
+	if perr := b.preload(changed); perr != nil {
+		return perr
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	return err
+}
+
+// reopen replaces the file handle with a fresh one for the same path,
+// reopens the sealed segments and rebuilds the index from them, so the
+// caller can continue from the start of the file. The caller holds the
+// write lock.
+func (b *Bitcask) reopen() error {
+	var file readFile
+	var osFile *os.File
+	var err error
+	if b.fsys != nil {
+		file, err = openFSFile(b.fsys, b.path)
+	} else {
+		osFile, err = os.Open(b.path)
+		file = osFile
+	}
+	if err != nil {
+		return err
+	}
+	format, err := readFileHeader(file, b.opts)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	b.src.Close()
+	b.file, b.src = osFile, file
+	b.format = format
+	b.setIndex(make(map[string]entry))
+	b.records = 0
+	b.dead = 0
+	b.clock = 0
+	b.end = format.dataStart
+	b.nextGeneration()
+
+	b.closeSegments(false)
+	if err := b.openSegments(); err != nil {
+		return err
+	}
+	return b.loadSegments(context.Background())
+}
@@ -0,0 +1,171 @@
+package atomkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	// ErrUnsupportedFormat is returned when a data file was written by a
+	// newer, incompatible version of atomkv.
+	ErrUnsupportedFormat = errors.New("unsupported data file format")
+
+	// ErrUpgradeRequired is returned by writes that need a record field
+	// the open file's format lacks, such as a TTL or a typed value.
+	// Compacting the database upgrades it to the current format.
+	ErrUpgradeRequired = errors.New("data file format too old for this write; compact to upgrade")
+)
+
+// File header:
+//
+//	| magic (4B) | version (1B) | timestamp mode (1B) | checksum type (1B) | sealed (4B) | reserved (5B) |
+//
+// Sealed is the highest segment id a compaction merged into this file;
+// see segment.go. It is zero in files that never had segments.
+//
+// Version 2 added a checksum to every record (the checksum type byte is
+// zero in version 1 files), version 3 an expiry time and version 4 record
+// flags. Files written before the header existed start
+// directly with a record. They are read as version 0 with nanosecond
+// timestamps.
+const (
+	fileHeaderSize = 16
+	formatVersion  = 4
+)
+
+var fileMagic = []byte("ATKV")
+
+// TimestampMode selects what the timestamp field of each record holds.
+// It is fixed when a file is created and recorded in the file header.
+type TimestampMode uint8
+
+const (
+	TimestampNanos   TimestampMode = iota // Unix time in nanoseconds (default)
+	TimestampMillis                       // Unix time in milliseconds
+	TimestampLogical                      // counter incremented on every write
+)
+
+// fileFormat is the decoded file header.
+type fileFormat struct {
+	version   uint8
+	tsMode    TimestampMode
+	checksum  ChecksumType // only meaningful when checksummed
+	sealed    uint32       // segments up to this id are superseded
+	dataStart int64        // offset of the first record
+}
+
+// checksummed reports whether records in this format carry a checksum.
+func (f fileFormat) checksummed() bool {
+	return f.version >= 2
+}
+
+// hasExpiry reports whether records in this format carry an expiry time.
+func (f fileFormat) hasExpiry() bool {
+	return f.version >= 3
+}
+
+// hasFlags reports whether records in this format carry a flags byte.
+func (f fileFormat) hasFlags() bool {
+	return f.version >= 4
+}
+
+// readFileHeader determines the format of file. An empty writable file is
+// initialised with a header built from opts; writable files are always
+// *os.File.
+func readFileHeader(file readFile, opts Options) (fileFormat, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return fileFormat{}, err
+	}
+
+	if info.Size() == 0 {
+		f := fileFormat{
+			version:  formatVersion,
+			tsMode:   opts.TimestampMode,
+			checksum: opts.ChecksumType,
+		}
+		if opts.ReadOnly {
+			return f, nil
+		}
+		if err := writeFileHeader(file.(*os.File), f); err != nil {
+			return fileFormat{}, err
+		}
+		f.dataStart = fileHeaderSize
+		return f, nil
+	}
+
+	header := make([]byte, fileHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil && err != io.EOF {
+		return fileFormat{}, err
+	}
+	if !bytes.Equal(header[0:4], fileMagic) {
+		return fileFormat{version: 0, tsMode: TimestampNanos}, nil
+	}
+
+	f := fileFormat{
+		version:   header[4],
+		tsMode:    TimestampMode(header[5]),
+		checksum:  ChecksumType(header[6]),
+		sealed:    binary.LittleEndian.Uint32(header[7:11]),
+		dataStart: fileHeaderSize,
+	}
+	if f.version > formatVersion || f.tsMode > TimestampLogical || f.checksum > ChecksumXXHash64 {
+		return fileFormat{}, ErrUnsupportedFormat
+	}
+	return f, nil
+}
+
+// writeFileHeader writes the header for f to file, which must be empty.
+// It seeks and writes rather than using WriteAt so that it also works on
+// handles opened with O_APPEND.
+func writeFileHeader(file *os.File, f fileFormat) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := file.Write(f.header())
+	return err
+}
+
+// header encodes the file header for f.
+func (f fileFormat) header() []byte {
+	header := make([]byte, fileHeaderSize)
+	copy(header[0:4], fileMagic)
+	header[4] = f.version
+	header[5] = byte(f.tsMode)
+	if f.checksummed() {
+		header[6] = byte(f.checksum)
+	}
+	binary.LittleEndian.PutUint32(header[7:11], f.sealed)
+	return header
+}
+
+// nextTimestamp returns the timestamp for a new record. The caller holds
+// the write lock.
+func (b *Bitcask) nextTimestamp() int64 {
+	switch b.format.tsMode {
+	case TimestampMillis:
+		return b.now().UnixMilli()
+	case TimestampLogical:
+		b.clock++
+		return b.clock
+	default:
+		return b.now().UnixNano()
+	}
+}
+
+// timeOf converts a stored timestamp to wall-clock time. Logical
+// timestamps have no wall-clock meaning and map to the zero Time.
+func (b *Bitcask) timeOf(ts int64) time.Time {
+	switch b.format.tsMode {
+	case TimestampMillis:
+		return time.UnixMilli(ts)
+	case TimestampLogical:
+		return time.Time{}
+	default:
+		return time.Unix(0, ts)
+	}
+}
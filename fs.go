@@ -0,0 +1,87 @@
+package atomkv
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+)
+
+// readFile is the read side of the data file: the *os.File itself, or a
+// file from an fs.FS for databases opened with OpenFS. Every read goes
+// through it; writes use the *os.File directly.
+type readFile interface {
+	io.ReaderAt
+	io.Closer
+	Stat() (fs.FileInfo, error)
+}
+
+// fsFile adapts a file from an fs.FS to readFile.
+type fsFile struct {
+	fs.File
+	io.ReaderAt
+}
+
+// OpenFS opens the database stored as name in fsys. The database is always
+// read-only, whatever opts says, which makes it possible to test read and
+// load paths against an fstest.MapFS or an embedded FS without touching
+// the filesystem. Files that do not support ReadAt are read into memory.
+func OpenFS(fsys fs.FS, name string, opts Options) (*Bitcask, error) {
+	opts = opts.withDefaults()
+	opts.ReadOnly = true
+	aead, err := newAEAD(opts.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := openFSFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := readFileHeader(file, opts)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	b := &Bitcask{
+		src:     file,
+		fsys:    fsys,
+		path:    name,
+		opts:    opts,
+		format:  format,
+		index:   make(map[string]entry),
+		ttlKeys: make(map[string]struct{}),
+		end:     info.Size(),
+		aead:    aead,
+	}
+	if opts.PreloadValues {
+		b.values = make(map[string]string)
+	}
+	if opts.ExpireInterval > 0 {
+		b.startExpirer()
+	}
+	return b, nil
+}
+
+func openFSFile(fsys fs.FS, name string) (readFile, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if ra, ok := f.(io.ReaderAt); ok {
+		return fsFile{f, ra}, nil
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return fsFile{f, bytes.NewReader(data)}, nil
+}
@@ -0,0 +1,208 @@
+package atomkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// A hint file sits next to the data file and holds what Load would learn
+// from scanning it: every live key with its record's location and header
+// fields. Loading it skips reading the values, which is most of the file.
+//
+// Layout, integers little endian:
+//
+//	Header: | magic "ATKH" (4B) | version (1B) | data format version (1B) | reserved (2B) |
+//	        | data size (8B) | records (8B) | clock (8B) | last segment (4B) | reserved (4B) |
+//	Entry:  | offset (8B) | timestamp (8B) | expiry (8B) | flags (1B) | key_len (4B) | val_len (4B) | segment (4B) | key |
+//	Footer: | CRC-32C of everything before it (4B) |
+//
+// A hint only describes the data file it was written for. Load uses it when
+// it is at least as new as the data file and the recorded data size and
+// newest sealed segment match; any other hint is ignored and the files are
+// scanned as usual.
+const (
+	hintSuffix     = ".hint"
+	hintMagic      = "ATKH"
+	hintVersion    = 1
+	hintHeaderSize = 40
+	hintEntrySize  = 37
+)
+
+// WriteHintFile records the current index in a hint file next to the data
+// file, so that the next Load can skip scanning the data file as long as
+// nothing is written in between. Compact does this automatically; see also
+// Options.HintOnClose.
+func (b *Bitcask) WriteHintFile() error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	return b.writeHint()
+}
+
+// writeHint writes the hint file for the current index, replacing any
+// previous one atomically. The caller holds the lock.
+func (b *Bitcask) writeHint() error {
+	// The hint describes the file as it is on disk.
+	if err := b.flushWrites(); err != nil {
+		return err
+	}
+	buf := make([]byte, hintHeaderSize)
+	copy(buf, hintMagic)
+	buf[4] = hintVersion
+	buf[5] = b.format.version
+	binary.LittleEndian.PutUint64(buf[8:], uint64(b.end))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(b.records))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(b.clock))
+	binary.LittleEndian.PutUint32(buf[32:], b.lastSegment())
+
+	for _, k := range b.keysByOffset() {
+		e := b.index[k]
+		flags := e.flags()
+		if e.shared {
+			flags |= flagShared
+		}
+		buf = appendHintEntry(buf, e.seg, e.offset, e.timestamp, e.expiry, flags, k, e.valueSize)
+	}
+	// Deletes of base keys must survive a restart of a layered database.
+	for _, k := range b.maskedKeys() {
+		buf = appendHintEntry(buf, 0, 0, 0, 0, 0, k, tombstone)
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crc32cTable))
+
+	f, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+hintSuffix+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), b.path+hintSuffix)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func appendHintEntry(buf []byte, seg uint32, offset, timestamp, expiry int64, flags uint8, key string, valueSize uint32) []byte {
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(offset))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(timestamp))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(expiry))
+	buf = append(buf, flags)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(key)))
+	buf = binary.LittleEndian.AppendUint32(buf, valueSize)
+	buf = binary.LittleEndian.AppendUint32(buf, seg)
+	return append(buf, key...)
+}
+
+// loadHint rebuilds the index from the hint file if there is one that
+// matches the data file, and reports whether it did. A damaged hint is
+// logged and ignored. The caller holds the write lock.
+func (b *Bitcask) loadHint(data fs.FileInfo) bool {
+	if b.fsys != nil {
+		return false
+	}
+	hintPath := b.path + hintSuffix
+	info, err := os.Stat(hintPath)
+	if err != nil || info.ModTime().Before(data.ModTime()) {
+		return false
+	}
+	buf, err := os.ReadFile(hintPath)
+	if err != nil {
+		return false
+	}
+	h, err := decodeHint(buf)
+	if err != nil {
+		b.logf("atomkv: %s: ignoring hint file: %v", b.path, err)
+		return false
+	}
+	if h.formatVersion != b.format.version || h.dataSize != data.Size() || h.lastSeg != b.lastSegment() {
+		return false
+	}
+
+	for _, he := range h.entries {
+		b.applyRecord(he.seg, he.offset, he.header, he.key)
+	}
+	b.records = h.records
+	b.clock = h.clock
+	return true
+}
+
+type hint struct {
+	formatVersion uint8
+	dataSize      int64
+	records       int64
+	clock         int64
+	lastSeg       uint32
+	entries       []hintEntry
+}
+
+type hintEntry struct {
+	seg    uint32
+	offset int64
+	header recordHeader
+	key    []byte
+}
+
+// decodeHint parses and verifies the contents of a hint file.
+func decodeHint(buf []byte) (hint, error) {
+	if len(buf) < hintHeaderSize+4 || !bytes.Equal(buf[:4], []byte(hintMagic)) || buf[4] != hintVersion {
+		return hint{}, errors.New("not a hint file")
+	}
+	body := buf[:len(buf)-4]
+	if crc32.Checksum(body, crc32cTable) != binary.LittleEndian.Uint32(buf[len(body):]) {
+		return hint{}, errors.New("checksum mismatch")
+	}
+	h := hint{
+		formatVersion: buf[5],
+		dataSize:      int64(binary.LittleEndian.Uint64(buf[8:])),
+		records:       int64(binary.LittleEndian.Uint64(buf[16:])),
+		clock:         int64(binary.LittleEndian.Uint64(buf[24:])),
+		lastSeg:       binary.LittleEndian.Uint32(buf[32:]),
+	}
+
+	for p := body[hintHeaderSize:]; len(p) > 0; {
+		if len(p) < hintEntrySize {
+			return hint{}, errors.New("truncated entry")
+		}
+		keySize := binary.LittleEndian.Uint32(p[25:])
+		if uint64(len(p)-hintEntrySize) < uint64(keySize) {
+			return hint{}, errors.New("truncated entry")
+		}
+		h.entries = append(h.entries, hintEntry{
+			seg:    binary.LittleEndian.Uint32(p[33:]),
+			offset: int64(binary.LittleEndian.Uint64(p)),
+			header: recordHeader{
+				timestamp: int64(binary.LittleEndian.Uint64(p[8:])),
+				expiry:    int64(binary.LittleEndian.Uint64(p[16:])),
+				flags:     p[24],
+				keySize:   keySize,
+				valueSize: binary.LittleEndian.Uint32(p[29:]),
+			},
+			key: p[hintEntrySize : hintEntrySize+int(keySize)],
+		})
+		p = p[hintEntrySize+int(keySize):]
+	}
+	return h, nil
+}
+
+// removeHint deletes the hint file, if any.
+func removeHint(path string) error {
+	err := os.Remove(path + hintSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package atomkv
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSnapshotInterval(t *testing.T) {
+	db, path := openTestDB(t, Options{SnapshotInterval: 10 * time.Millisecond})
+
+	// hinted waits for the hint file to describe the data file as it is
+	// now, which is what lets the next Load use it.
+	hinted := func() {
+		t.Helper()
+		want := db.LogSize()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			buf, err := os.ReadFile(path + hintSuffix)
+			if err != nil {
+				continue
+			}
+			h, err := decodeHint(buf)
+			if err != nil {
+				t.Fatalf("hint file: %v", err)
+			}
+			if h.dataSize == want {
+				return
+			}
+		}
+		t.Fatalf("no hint for a data size of %d bytes", want)
+	}
+
+	// Nothing is hinted before Load, when the index is still empty.
+	if err := db.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(path + hintSuffix); !os.IsNotExist(err) {
+		t.Fatalf("hint file before Load: %v", err)
+	}
+
+	if err := db.Load(); err != nil {
+		t.Fatal(err)
+	}
+	hinted()
+	if err := db.Set("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	hinted()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.mu.Lock()
+	used := reopened.loadHint(info)
+	reopened.mu.Unlock()
+	if !used {
+		t.Fatal("the periodic hint does not match the data file")
+	}
+	if keys := reopened.Keys(); len(keys) != 1 || keys[0] != "b" {
+		t.Fatalf("keys from the hint = %q; want [b]", keys)
+	}
+}
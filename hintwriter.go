@@ -0,0 +1,64 @@
+package atomkv
+
+import "time"
+
+// startHintWriter launches the goroutine behind Options.SnapshotInterval.
+// The caller holds the write lock.
+func (b *Bitcask) startHintWriter() {
+	b.stopHint = make(chan struct{})
+	b.hintDone = make(chan struct{})
+
+	go func() {
+		defer close(b.hintDone)
+
+		ticker := time.NewTicker(b.opts.SnapshotInterval)
+		defer ticker.Stop()
+		var last hintMark
+		for {
+			select {
+			case <-b.stopHint:
+				return
+			case <-ticker.C:
+				if err := b.writeHintIfChanged(&last); err != nil {
+					b.logf("atomkv: %s: periodic hint failed: %v", b.path, err)
+				}
+			}
+		}
+	}()
+}
+
+// hintMark identifies the state of the data file a hint was written for.
+type hintMark struct {
+	written    bool
+	generation uint64
+	end        int64
+}
+
+// writeHintIfChanged writes a hint file unless the data file is as it was
+// when last was written, and updates last.
+func (b *Bitcask) writeHintIfChanged(last *hintMark) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	mark := hintMark{written: true, generation: b.generation, end: b.end}
+	if mark == *last {
+		return nil
+	}
+	if err := b.writeHint(); err != nil {
+		return err
+	}
+	*last = mark
+	return nil
+}
+
+// stopHintWriter stops the periodic hint goroutine, if running, and waits
+// for it to exit. It is safe to call more than once.
+func (b *Bitcask) stopHintWriter() {
+	if b.stopHint == nil {
+		return
+	}
+	b.stopHinting.Do(func() {
+		close(b.stopHint)
+		<-b.hintDone
+	})
+}
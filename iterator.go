@@ -0,0 +1,83 @@
+package atomkv
+
+// Iterator walks the keys and values of a database one pair at a time.
+// It iterates over a snapshot of the index taken by Bitcask.Iterator, so
+// writes made while it is open neither stop it nor show up in it, and it
+// holds only one value in memory at a time.
+//
+// An Iterator is not safe for concurrent use.
+type Iterator struct {
+	b       *Bitcask
+	keys    []string
+	entries []entry // index entries of the first len(entries) keys; the rest are base keys
+	gen     uint64
+	pos     int
+}
+
+// Iterator returns an iterator over every live key, in the order the
+// records appear in the data file, followed by keys only the base layer
+// has. Call Next before reading the first pair and Close when done.
+//
+// Values are read with ReadAt when Value is called, so the iterator holds
+// no lock between calls. If the file is compacted or rotated while the
+// iterator is open, Value reads the key's current value instead, and
+// returns ErrKeyNotFound for keys deleted since.
+func (b *Bitcask) Iterator() *Iterator {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	keys := b.keysByOffset()
+	entries := make([]entry, len(keys))
+	for i, k := range keys {
+		entries[i] = b.index[k]
+	}
+	keys = append(keys, b.baseKeys("")...)
+	return &Iterator{b: b, keys: keys, entries: entries, gen: b.generation, pos: -1}
+}
+
+// Next advances to the next pair and reports whether there is one.
+func (it *Iterator) Next() bool {
+	if it.pos < len(it.keys) {
+		it.pos++
+	}
+	return it.pos < len(it.keys)
+}
+
+// Key returns the key of the current pair.
+func (it *Iterator) Key() string {
+	return it.keys[it.pos]
+}
+
+// Value reads the value of the current pair. Typed values are returned
+// in the text form Get uses.
+func (it *Iterator) Value() ([]byte, error) {
+	b := it.b
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	key := it.keys[it.pos]
+	var raw []byte
+	var vt valueType
+	var err error
+	if it.pos < len(it.entries) && b.generation == it.gen {
+		e := it.entries[it.pos]
+		raw, err = b.readValue(key, e)
+		vt = e.vtype
+	} else {
+		raw, vt, err = b.rawValue(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if vt == typeString || vt == typeBytes {
+		return raw, nil
+	}
+	return []byte(vt.text(raw)), nil
+}
+
+// Close releases the snapshot. Next returns false afterwards.
+func (it *Iterator) Close() {
+	it.keys = nil
+	it.entries = nil
+	it.pos = 0
+}
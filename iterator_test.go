@@ -0,0 +1,42 @@
+package atomkv
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestIteratorAcrossReset(t *testing.T) {
+	db, _ := openTestDB(t, Options{})
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}, {"c", "3"}} {
+		if err := db.Set(kv[0], kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	it := db.Iterator()
+	defer it.Close()
+
+	// After the Reset, the iterator's offsets point at other keys'
+	// records in the new file; it must look the keys up again.
+	if err := db.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("b", "4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("a", "5"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"a": "5", "b": "4"}
+	for it.Next() {
+		key := it.Key()
+		v, err := it.Value()
+		if w, ok := want[key]; ok {
+			if err != nil || string(v) != w {
+				t.Fatalf("Value(%s) = %q, %v; want %q", key, v, err, w)
+			}
+		} else if !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("Value(%s) = %q, %v; want ErrKeyNotFound", key, v, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package atomkv
+
+import (
+	"sort"
+	"strings"
+)
+
+// OpenLayered opens a writable overlay database on top of a read-only base,
+// so a large shipped dataset can be customised without copying it. Both
+// files are loaded before OpenLayered returns.
+//
+// Writes go to the overlay. Get, Lookup, the typed getters, Keys,
+// ScanValues and ForEach see the overlay first and fall back to the base;
+// deleting a base key writes a tombstone to the overlay that hides it, and
+// compaction keeps those tombstones. Methods about the file itself, such as
+// KeyInfo, Stats, IndexReport, Changes and watches, cover only the overlay.
+// Close closes both files.
+func OpenLayered(basePath, overlayPath string) (_ *Bitcask, err error) {
+	base, err := OpenWithOptions(basePath, Options{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			base.Close()
+		}
+	}()
+	if err := base.Load(); err != nil {
+		return nil, err
+	}
+
+	overlay, err := OpenWithOptions(overlayPath, Options{})
+	if err != nil {
+		return nil, err
+	}
+	overlay.base = base
+	overlay.masked = make(map[string]struct{})
+	if err := overlay.Load(); err != nil {
+		overlay.Close()
+		return nil, err
+	}
+	return overlay, nil
+}
+
+// fromBase reports whether reads of key fall through to the base layer:
+// the overlay neither holds nor hides it. The caller holds the read lock.
+func (b *Bitcask) fromBase(key string) bool {
+	if b.base == nil {
+		return false
+	}
+	if _, ok := b.index[key]; ok {
+		return false
+	}
+	_, hidden := b.masked[key]
+	return !hidden
+}
+
+// exists reports whether key is visible in b or its base. The caller holds
+// the read lock.
+func (b *Bitcask) exists(key string) bool {
+	if _, ok := b.lookup(key); ok {
+		return true
+	}
+	return b.fromBase(key) && b.base.has(key)
+}
+
+// has reports whether key is live, taking the read lock.
+func (b *Bitcask) has(key string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, ok := b.lookup(key)
+	return ok
+}
+
+// baseKeys returns the live base keys starting with prefix that the
+// overlay does not shadow. The caller holds the read lock.
+func (b *Bitcask) baseKeys(prefix string) []string {
+	if b.base == nil {
+		return nil
+	}
+	var keys []string
+	for _, k := range b.base.Keys() {
+		if strings.HasPrefix(k, prefix) && b.fromBase(k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// maskedKeys returns the base keys the overlay hides, sorted.
+func (b *Bitcask) maskedKeys() []string {
+	keys := make([]string, 0, len(b.masked))
+	for k := range b.masked {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
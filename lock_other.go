@@ -0,0 +1,12 @@
+//go:build !(linux || darwin)
+
+package atomkv
+
+import "os"
+
+// lockFile reports that f is locked without locking it, on platforms
+// without flock: every writer then owns the clean-shutdown marker and the
+// first to close removes it.
+func lockFile(f *os.File) (bool, error) {
+	return true, nil
+}
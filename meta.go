@@ -0,0 +1,150 @@
+package atomkv
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// A record with flagMeta set stores metadata after its value:
+//
+//	| value | metadata | metadata size (4B) |
+//
+// The metadata holds the pairs in key order, each key and value prefixed
+// with its length as a uvarint. The value size in the record header covers
+// all three parts, so scanning is unchanged.
+
+const metaSizeSize = 4 // size of the trailing metadata size field
+
+// SetWithMeta writes value like Set and attaches meta to it, for example a
+// content type or owner. The metadata belongs to this write: a later Set
+// of the key without metadata drops it. It requires the current file
+// format; older files return ErrUpgradeRequired until compacted.
+func (b *Bitcask) SetWithMeta(key, value string, meta map[string]string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.format.hasFlags() {
+		return ErrUpgradeRequired
+	}
+	return b.set(key, []byte(value), typeString, 0, meta)
+}
+
+// GetMeta returns the metadata stored with key's current value, or nil if
+// it has none.
+func (b *Bitcask) GetMeta(key string) (map[string]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	e, exists := b.lookup(key)
+	if !exists {
+		if b.fromBase(key) {
+			return b.base.GetMeta(key)
+		}
+		return nil, ErrKeyNotFound
+	}
+	if !e.meta {
+		return nil, nil
+	}
+	payload, err := b.readPayload(key, e)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMeta(payload)
+}
+
+// GetValueAndMeta returns key's value, as Get does, together with the
+// metadata GetMeta would return. Both come from the same record under one
+// read lock, so a concurrent write cannot pair the value of one write with
+// the metadata of another.
+func (b *Bitcask) GetValueAndMeta(key string) (value string, meta map[string]string, err error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	b.gets.Add(1)
+
+	e, exists := b.lookup(key)
+	if !exists && b.fromBase(key) {
+		return b.base.GetValueAndMeta(key)
+	}
+	if value, _, err = b.get(key); err != nil || !e.meta {
+		return value, nil, err
+	}
+	payload, err := b.readPayload(key, e)
+	if err != nil {
+		return "", nil, err
+	}
+	if meta, err = decodeMeta(payload); err != nil {
+		return "", nil, err
+	}
+	return value, meta, nil
+}
+
+// appendMeta appends the encoded meta and its size to buf.
+func appendMeta(buf []byte, meta map[string]string) []byte {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	start := len(buf)
+	for _, k := range keys {
+		buf = binary.AppendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+		buf = binary.AppendUvarint(buf, uint64(len(meta[k])))
+		buf = append(buf, meta[k]...)
+	}
+	return binary.LittleEndian.AppendUint32(buf, uint32(len(buf)-start))
+}
+
+// splitMeta splits a flagMeta payload into the value and the encoded
+// metadata.
+func splitMeta(payload []byte) (value, meta []byte, err error) {
+	if len(payload) < metaSizeSize {
+		return nil, nil, ErrCorruptRecord
+	}
+	end := len(payload) - metaSizeSize
+	size := binary.LittleEndian.Uint32(payload[end:])
+	if uint64(size) > uint64(end) {
+		return nil, nil, ErrCorruptRecord
+	}
+	start := end - int(size)
+	return payload[:start], payload[start:end], nil
+}
+
+// stripMeta returns the value of a flagMeta payload.
+func stripMeta(payload []byte) ([]byte, error) {
+	value, _, err := splitMeta(payload)
+	return value, err
+}
+
+// decodeMeta returns the metadata of a flagMeta payload.
+func decodeMeta(payload []byte) (map[string]string, error) {
+	_, p, err := splitMeta(payload)
+	if err != nil {
+		return nil, err
+	}
+	meta := make(map[string]string)
+	for len(p) > 0 {
+		k, rest, ok := metaString(p)
+		if !ok {
+			return nil, ErrCorruptRecord
+		}
+		v, rest, ok := metaString(rest)
+		if !ok {
+			return nil, ErrCorruptRecord
+		}
+		meta[k] = v
+		p = rest
+	}
+	return meta, nil
+}
+
+// metaString decodes one length-prefixed string from p.
+func metaString(p []byte) (s string, rest []byte, ok bool) {
+	n, size := binary.Uvarint(p)
+	if size <= 0 || n > uint64(len(p)-size) {
+		return "", nil, false
+	}
+	p = p[size:]
+	return string(p[:n]), p[n:], true
+}
@@ -0,0 +1,49 @@
+package atomkv
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGetValueAndMetaConsistent(t *testing.T) {
+	db, _ := openTestDB(t, Options{})
+	if err := db.Set("k", "plain"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes alternate between values carrying their own name as metadata
+	// and a value with none; a reader must never see a mixed pair.
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 500; i++ {
+			value := fmt.Sprint(i)
+			if err := db.SetWithMeta("k", value, map[string]string{"value": value}); err != nil {
+				done <- err
+				return
+			}
+			if err := db.Set("k", "plain"); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		default:
+		}
+		value, meta, err := db.GetValueAndMeta("k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value == "plain" && meta != nil || value != "plain" && meta["value"] != value {
+			t.Fatalf("GetValueAndMeta = %q, %v; want metadata from the same write", value, meta)
+		}
+	}
+}
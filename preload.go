@@ -0,0 +1,29 @@
+package atomkv
+
+// cacheValue records key's new encoded value when PreloadValues is set.
+// The caller holds the write lock.
+func (b *Bitcask) cacheValue(key string, value []byte) {
+	if b.values != nil {
+		b.values[key] = string(value)
+	}
+}
+
+// preload reads the current values of keys into memory when PreloadValues
+// is set. Keys no longer live are skipped. The caller holds the write lock.
+func (b *Bitcask) preload(keys []string) error {
+	if b.values == nil {
+		return nil
+	}
+	for _, key := range keys {
+		e, ok := b.lookup(key)
+		if !ok {
+			continue
+		}
+		value, err := b.readValue(key, e)
+		if err != nil {
+			return err
+		}
+		b.cacheValue(key, value)
+	}
+	return nil
+}
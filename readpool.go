@@ -0,0 +1,127 @@
+package atomkv
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// errReadPoolFull is returned by readPool.get when every descriptor the
+// pool may open is in use.
+var errReadPoolFull = errors.New("all read handles in use")
+
+// readPool keeps idle read-only descriptors of the data file so that
+// concurrent Gets each read through their own handle instead of sharing
+// one. Idle descriptors are closed whenever a compaction, rotation, seal,
+// refresh or Reset swaps the file, and every descriptor is tagged with
+// the generation it was opened in, so one that was in use during the swap
+// is closed instead of reused when it comes back. No more than the
+// pool's size are open at once, idle or in use.
+type readPool struct {
+	path   string
+	idle   chan pooledReader
+	slots  chan struct{} // one token per open descriptor
+	closed atomic.Bool
+}
+
+type pooledReader struct {
+	f   *os.File
+	gen uint64
+}
+
+func newReadPool(path string, size int) *readPool {
+	return &readPool{
+		path:  path,
+		idle:  make(chan pooledReader, size),
+		slots: make(chan struct{}, size),
+	}
+}
+
+// get returns an idle descriptor opened in generation gen, or opens a new
+// one if fewer than the pool's size are open, or fails with
+// errReadPoolFull. The caller holds the read lock, so path names that
+// generation's file.
+func (p *readPool) get(gen uint64) (pooledReader, error) {
+	for {
+		select {
+		case r := <-p.idle:
+			if r.gen == gen {
+				return r, nil
+			}
+			p.release(r)
+		default:
+			select {
+			case p.slots <- struct{}{}:
+			default:
+				return pooledReader{}, errReadPoolFull
+			}
+			f, err := os.Open(p.path)
+			if err != nil {
+				<-p.slots
+				return pooledReader{}, err
+			}
+			return pooledReader{f: f, gen: gen}, nil
+		}
+	}
+}
+
+// release closes r and frees its slot.
+func (p *readPool) release(r pooledReader) {
+	r.f.Close()
+	<-p.slots
+}
+
+// put returns r to the pool, closing it if the pool is full or closed.
+func (p *readPool) put(r pooledReader) {
+	if !p.closed.Load() {
+		select {
+		case p.idle <- r:
+			return
+		default:
+		}
+	}
+	p.release(r)
+}
+
+// close closes every idle descriptor; descriptors still in use are closed
+// when they are put back.
+func (p *readPool) close() {
+	p.closed.Store(true)
+	p.drop()
+}
+
+// drop closes every idle descriptor. It is called when the data file is
+// swapped, so that none opened on the replaced file is reused.
+func (p *readPool) drop() {
+	for {
+		select {
+		case r := <-p.idle:
+			p.release(r)
+		default:
+			return
+		}
+	}
+}
+
+// readAt reads from the data file at offset, through a pooled descriptor
+// when ReadHandles is set. If every pooled descriptor is busy, or none can
+// be opened, for instance because the process is out of them, it reads
+// through the shared handle. The caller holds the read lock.
+func (b *Bitcask) readAt(p []byte, offset int64) (int, error) {
+	if n, ok := b.readBuffered(p, offset); ok {
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	if b.readers == nil {
+		return b.src.ReadAt(p, offset)
+	}
+	r, err := b.readers.get(b.generation)
+	if err != nil {
+		return b.src.ReadAt(p, offset)
+	}
+	defer b.readers.put(r)
+	return r.f.ReadAt(p, offset)
+}
@@ -0,0 +1,166 @@
+package atomkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Record layout:
+//
+//	| checksum (8B) | timestamp (8B) | expiry (8B) | flags (1B) | key size (4B) | value size (4B) | key | value |
+//
+// The checksum covers the rest of the record. The low three flag bits hold
+// the value type, flagShared marks a value stored elsewhere (see dedup.go),
+// flagMeta a value followed by metadata (see meta.go), flagCompressed a
+// compressed value (see compress.go) and flagEncrypted an encrypted one
+// (see encrypt.go); the top bit is reserved. Each field was added by a format
+// version: checksums in 2, expiry in 3 and flags in 4. Records in older
+// files simply lack the newer fields.
+
+// errChecksumMismatch is returned for a record whose checksum is wrong.
+var errChecksumMismatch = fmt.Errorf("%w: checksum mismatch", ErrCorruptRecord)
+
+// errTornRecord is returned by scanRecords for a last record that fails its
+// checksum: a write cut short by a crash after the file had grown, as
+// opposed to a damaged record with more data after it.
+var errTornRecord = fmt.Errorf("%w at end of file", errChecksumMismatch)
+
+const (
+	checksumSize = 8 // size of the record checksum field
+	expirySize   = 8 // size of the record expiry field
+	flagsSize    = 1 // size of the record flags field
+
+	flagShared     = 0x08 // the value is a reference to another record's value
+	flagMeta       = 0x10 // the value is followed by metadata
+	flagCompressed = 0x20 // the value and metadata are compressed
+	flagEncrypted  = 0x40 // the value and metadata are encrypted
+)
+
+// recordHeader is the decoded header of a record.
+type recordHeader struct {
+	checksum  uint64 // zero in formats without checksums
+	timestamp int64
+	expiry    int64 // Unix nanoseconds; zero means the record never expires
+	flags     uint8
+	keySize   uint32
+	valueSize uint32
+}
+
+// recordHeaderSize returns the size of a record header in this format.
+func (f fileFormat) recordHeaderSize() int64 {
+	size := int64(headerSize)
+	if f.checksummed() {
+		size += checksumSize
+	}
+	if f.hasExpiry() {
+		size += expirySize
+	}
+	if f.hasFlags() {
+		size += flagsSize
+	}
+	return size
+}
+
+// recordSize returns the on-disk size of a record with the given key and
+// value sizes. Tombstones carry no value bytes.
+func (f fileFormat) recordSize(keySize int, valueSize uint32) int64 {
+	size := f.recordHeaderSize() + int64(keySize)
+	if valueSize != tombstone {
+		size += int64(valueSize)
+	}
+	return size
+}
+
+// putHeader encodes h into p, which must be recordHeaderSize bytes long.
+func (f fileFormat) putHeader(p []byte, h recordHeader) {
+	if f.checksummed() {
+		binary.LittleEndian.PutUint64(p, h.checksum)
+		p = p[checksumSize:]
+	}
+	binary.LittleEndian.PutUint64(p, uint64(h.timestamp))
+	p = p[8:]
+	if f.hasExpiry() {
+		binary.LittleEndian.PutUint64(p, uint64(h.expiry))
+		p = p[expirySize:]
+	}
+	if f.hasFlags() {
+		p[0] = h.flags
+		p = p[flagsSize:]
+	}
+	binary.LittleEndian.PutUint32(p[0:4], h.keySize)
+	binary.LittleEndian.PutUint32(p[4:8], h.valueSize)
+}
+
+// decodeHeader decodes a record header of length recordHeaderSize.
+func (f fileFormat) decodeHeader(p []byte) recordHeader {
+	var h recordHeader
+	if f.checksummed() {
+		h.checksum = binary.LittleEndian.Uint64(p)
+		p = p[checksumSize:]
+	}
+	h.timestamp = int64(binary.LittleEndian.Uint64(p))
+	p = p[8:]
+	if f.hasExpiry() {
+		h.expiry = int64(binary.LittleEndian.Uint64(p))
+		p = p[expirySize:]
+	}
+	if f.hasFlags() {
+		h.flags = p[0]
+		p = p[flagsSize:]
+	}
+	h.keySize = binary.LittleEndian.Uint32(p[0:4])
+	h.valueSize = binary.LittleEndian.Uint32(p[4:8])
+	return h
+}
+
+// encodeRecord appends a record to buf and returns the extended slice. A nil
+// value with deleted set encodes a tombstone.
+func (f fileFormat) encodeRecord(buf []byte, timestamp, expiry int64, flags uint8, key string, value []byte, deleted bool) []byte {
+	h := recordHeader{
+		timestamp: timestamp,
+		expiry:    expiry,
+		flags:     flags,
+		keySize:   uint32(len(key)),
+		valueSize: uint32(len(value)),
+	}
+	if deleted {
+		h.valueSize = tombstone
+	}
+
+	start := len(buf)
+	buf = append(buf, make([]byte, f.recordHeaderSize())...)
+	f.putHeader(buf[start:], h)
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+
+	if f.checksummed() {
+		sum := f.checksum.sum(buf[start+checksumSize:])
+		binary.LittleEndian.PutUint64(buf[start:], sum)
+	}
+	return buf
+}
+
+// recordValue returns the value of a complete encoded record, verifying its
+// checksum first if the format has one.
+func (f fileFormat) recordValue(record []byte, keySize int) ([]byte, error) {
+	if f.checksummed() {
+		stored := binary.LittleEndian.Uint64(record)
+		if f.checksum.sum(record[checksumSize:]) != stored {
+			return nil, errChecksumMismatch
+		}
+	}
+	return record[f.recordHeaderSize()+int64(keySize):], nil
+}
+
+// keyedRecordValue is recordValue for a record that must belong to key. A
+// record for any other key means the offset it was read from is wrong,
+// which is reported as corruption; offset only appears in the error.
+func (f fileFormat) keyedRecordValue(record []byte, key string, offset int64) ([]byte, error) {
+	hdr := f.recordHeaderSize()
+	h := f.decodeHeader(record)
+	if h.keySize != uint32(len(key)) || !bytes.Equal(record[hdr:hdr+int64(len(key))], []byte(key)) {
+		return nil, fmt.Errorf("%w: record at offset %d is not for key %q", ErrCorruptRecord, offset, key)
+	}
+	return f.recordValue(record, len(key))
+}
@@ -0,0 +1,128 @@
+package atomkv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// dirtySuffix is appended to the database path to name the marker file
+// that exists while the database is open for writing. A marker left behind
+// means the last writer did not close cleanly.
+const dirtySuffix = ".dirty"
+
+// markDirty creates the marker for the database at path and takes
+// ownership of it: the returned file holds an exclusive lock on the marker
+// until markClean, and records the owner's process id for people
+// inspecting it. If another handle, in this process or another, already
+// owns the marker, markDirty returns nil and leaves it alone, so that the
+// owner's marker outlives every other writer. A marker left by a writer
+// that crashed is not locked and is taken over.
+func markDirty(path string) (*os.File, error) {
+	f, err := os.OpenFile(path+dirtySuffix, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	owned, err := lockFile(f)
+	if err != nil || !owned {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(f, "%d\n", os.Getpid()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// markClean removes the marker owned through f and releases it. A nil f,
+// a marker owned by someone else, is left in place.
+func markClean(f *os.File) error {
+	if f == nil {
+		return nil
+	}
+	// Remove before unlocking, so no writer opening now takes over a
+	// marker that is about to disappear.
+	err := os.Remove(f.Name())
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// NeedsRecovery reports whether the database at path may be damaged: its
+// last writer did not Close cleanly, or the file ends in a torn record,
+// either cut short or failing its checksum. It opens the file read-only and
+// changes nothing, so scripts can run it before starting the main process
+// to decide whether a repair step is needed. A missing file needs no
+// recovery. A corrupt record with more records after it is not something
+// truncation can repair, and is returned as an error wrapping
+// ErrCorruptRecord.
+//
+// A database that is currently open for writing also reports true, since
+// its clean-shutdown marker is present.
+func NeedsRecovery(path string) (bool, error) {
+	if _, err := os.Stat(path + dirtySuffix); err == nil {
+		return true, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	format, err := readFileHeader(file, Options{ReadOnly: true})
+	if err != nil {
+		return false, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	return tornTail(file, format, info.Size())
+}
+
+// tornTail reports whether the records of file, which is size bytes long,
+// end in a record that is incomplete or fails its checksum: the cases
+// that Options.RepairOnLoad repairs. A corrupt record further in is
+// returned as an error.
+func tornTail(file *os.File, format fileFormat, size int64) (bool, error) {
+	next, err := scanRecords(file, format, format.dataStart, size, func(int64, recordHeader, []byte) error {
+		return nil
+	})
+	if damagedTail(err) {
+		return true, nil
+	}
+	return false, loadError(file.Name(), next, err)
+}
+
+// loadError describes a damaged record that stopped Load at offset. I/O
+// and context errors are returned as they are.
+func loadError(path string, offset int64, err error) error {
+	if !damagedTail(err) && !errors.Is(err, ErrCorruptRecord) {
+		return err
+	}
+	return fmt.Errorf("%s: damaged record at offset %d: %w", path, offset, err)
+}
+
+// damagedTail reports whether err from scanRecords means the file ends in
+// a torn record, one cut short or failing its checksum with nothing after
+// it, as opposed to an I/O failure or a corrupt record in the middle of
+// the file.
+func damagedTail(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errTornRecord)
+}
@@ -0,0 +1,65 @@
+package atomkv
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestLoadDamagedHeaderSize(t *testing.T) {
+	db, path := openTestDB(t, Options{})
+	if err := db.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	// The key size is the second to last field of the header.
+	at := db.index["b"].offset + db.format.recordHeaderSize() - 8
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], 0xFFFFFFF0)
+	if _, err := f.WriteAt(size[:], at); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	strict, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err = strict.Load()
+	runtime.ReadMemStats(&after)
+	strict.Close()
+	if !errors.Is(err, ErrCorruptRecord) && !damagedTail(err) {
+		t.Fatalf("Load = %v; want a damaged record error", err)
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 64<<20 {
+		t.Fatalf("Load allocated %d MB for a damaged header", n>>20)
+	}
+
+	repaired, err := OpenWithOptions(path, Options{RepairOnLoad: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repaired.Close()
+	if err := repaired.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := repaired.Keys(); len(keys) != 1 || keys[0] != "a" {
+		t.Fatalf("keys after repair = %q; want [a]", keys)
+	}
+}
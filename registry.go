@@ -0,0 +1,43 @@
+package atomkv
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+)
+
+// ErrAlreadyOpen is returned when a database is opened for writing while
+// this process already has a writable handle on the same path. Two handles
+// would keep separate indexes and corrupt each other's view of the file.
+var ErrAlreadyOpen = errors.New("database is already open for writing in this process")
+
+// openPaths holds the absolute paths of the databases this process has
+// open for writing.
+var openPaths = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// claimPath registers a writable handle on path, returning the key to pass
+// to releasePath, or ErrAlreadyOpen.
+func claimPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	openPaths.Lock()
+	defer openPaths.Unlock()
+	if openPaths.m[abs] {
+		return "", ErrAlreadyOpen
+	}
+	openPaths.m[abs] = true
+	return abs, nil
+}
+
+// releasePath ends a claim made by claimPath.
+func releasePath(abs string) {
+	openPaths.Lock()
+	defer openPaths.Unlock()
+	delete(openPaths.m, abs)
+}
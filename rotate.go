@@ -0,0 +1,84 @@
+package atomkv
+
+import "os"
+
+// Rotate archives the current data file at archivePath and continues with
+// a new, empty file, for time-windowed data that is retired wholesale. The
+// archived keys are no longer visible through b; the archive is a complete
+// database that can be opened on its own. archivePath must not exist and
+// must be on the same filesystem as the database. A database with sealed
+// segments (see Options.MaxSegmentSize) must be compacted first.
+//
+// The old file is hard-linked to archivePath before an empty file is
+// renamed over the database path, so a crash at any point leaves the data
+// reachable from at least one of the two paths. If Rotate fails the
+// database is left as it was.
+func (b *Bitcask) Rotate(archivePath string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if len(b.segments) > 0 {
+		return errSegmented
+	}
+
+	format := fileFormat{
+		version:   formatVersion,
+		tsMode:    b.format.tsMode,
+		checksum:  b.opts.ChecksumType,
+		sealed:    b.format.sealed,
+		dataStart: fileHeaderSize,
+	}
+	if b.format.checksummed() {
+		format.checksum = b.format.checksum
+	}
+
+	tempPath := b.path + ".tmp"
+	tempFile, err := os.OpenFile(tempPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, b.opts.FileMode)
+	if err != nil {
+		return err
+	}
+	if err := writeFileHeader(tempFile, format); err == nil {
+		err = tempFile.Sync()
+	}
+	tempFile.Close()
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	if err := b.syncFile(); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err := os.Link(b.path, archivePath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, b.path); err != nil {
+		os.Remove(archivePath)
+		os.Remove(tempPath)
+		return err
+	}
+
+	newFile, err := os.OpenFile(b.path, os.O_RDWR|os.O_APPEND, b.opts.FileMode)
+	if err != nil {
+		// Put the old file back; the handle still refers to it.
+		os.Rename(archivePath, b.path)
+		return err
+	}
+
+	b.file.Close()
+	b.file = newFile
+	b.src = newFile
+	b.format = format
+	b.setIndex(make(map[string]entry))
+	clear(b.masked)
+	b.end = format.dataStart
+	b.records = 0
+	b.dead = 0
+	b.nextGeneration()
+	return nil
+}
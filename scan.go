@@ -0,0 +1,99 @@
+package atomkv
+
+import (
+	"bufio"
+	"io"
+)
+
+const scanReadBufferSize = 64 * 1024
+
+// scanRecords reads the records of format f stored in r between start and
+// end, in file order, and calls fn with each record's offset, header and key.
+// Values are streamed through the checksum, if the format has one, without
+// being held in memory; a record that fails it is not handed to fn and
+// stops the scan with an error wrapping ErrCorruptRecord, errTornRecord if
+// it is the last record before end. It returns the offset just past the
+// last record handed to fn; when the data ends partway through a record, or
+// a header claims more bytes than are left before end, the error is
+// io.ErrUnexpectedEOF or io.EOF.
+func scanRecords(r io.ReaderAt, f fileFormat, start, end int64, fn func(offset int64, h recordHeader, key []byte) error) (int64, error) {
+	br := bufio.NewReaderSize(io.NewSectionReader(r, start, end-start), scanReadBufferSize)
+	header := make([]byte, f.recordHeaderSize())
+
+	offset := start
+	for offset < end {
+		if _, err := io.ReadFull(br, header); err != nil {
+			return offset, err
+		}
+		h := f.decodeHeader(header)
+
+		// The sizes are not checksummed until the record has been read,
+		// so a damaged header must not decide how much to allocate.
+		size := f.recordSize(int(h.keySize), h.valueSize)
+		if size > end-offset {
+			return offset, io.ErrUnexpectedEOF
+		}
+		key := make([]byte, h.keySize)
+		if _, err := io.ReadFull(br, key); err != nil {
+			return offset, io.ErrUnexpectedEOF
+		}
+		var sum checksummer
+		var value io.Writer = io.Discard
+		if f.checksummed() {
+			sum = f.checksum.new()
+			sum.Write(header[checksumSize:])
+			sum.Write(key)
+			value = sum
+		}
+		if h.valueSize != tombstone {
+			if _, err := io.CopyN(value, br, int64(h.valueSize)); err != nil {
+				return offset, io.ErrUnexpectedEOF
+			}
+		}
+		if sum != nil && sum.Sum64() != h.checksum {
+			if offset+size >= end {
+				return offset, errTornRecord
+			}
+			return offset, errChecksumMismatch
+		}
+
+		if err := fn(offset, h, key); err != nil {
+			return offset, err
+		}
+		offset += size
+	}
+	return offset, nil
+}
+
+// DuplicateStats scans the segments and the data file and returns the number of
+// distinct live keys and the total number of records, stale and deleted
+// ones included. The gap between the two is what compaction would remove.
+// Only record headers and keys are read, so it is reasonably fast, and
+// unlike the in-memory counters it reflects exactly what is on disk.
+func (b *Bitcask) DuplicateStats() (uniqueKeys int, totalRecords int, err error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	live := make(map[string]bool)
+	count := func(_ int64, h recordHeader, key []byte) error {
+		totalRecords++
+		if h.valueSize == tombstone {
+			delete(live, string(key))
+		} else {
+			live[string(key)] = true
+		}
+		return nil
+	}
+	for _, s := range b.segments {
+		if _, err := scanRecords(s.file, b.format, b.format.dataStart, s.size, count); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := b.flushWrites(); err != nil {
+		return 0, 0, err
+	}
+	if _, err := scanRecords(b.src, b.format, b.format.dataStart, b.end, count); err != nil {
+		return 0, 0, err
+	}
+	return len(live), totalRecords, nil
+}
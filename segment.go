@@ -0,0 +1,357 @@
+package atomkv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// With Options.MaxSegmentSize set, the data file is split into segments.
+// Writes always go to the active file at the database path. Once it has
+// grown to MaxSegmentSize, the next write first seals it: the file is
+// renamed to <path>.seg<id>, with ids increasing from 1, and a new, empty
+// active file takes its place. Sealed segments are immutable and stay open
+// for reads; index entries record the segment holding each record.
+//
+// Compact merges every segment and the active file into a new active file
+// and deletes the segments. Its header records the highest segment id it
+// absorbed, so segments left behind by a crash before they were deleted
+// are recognised as stale when the database is next opened.
+
+// errSegmented is returned by operations that only handle a single data
+// file.
+var errSegmented = errors.New("database has sealed segments; compact it first")
+
+// segment is a sealed data file.
+type segment struct {
+	id   uint32
+	path string
+	file *os.File
+	size int64
+}
+
+func segmentPath(path string, id uint32) string {
+	return fmt.Sprintf("%s.seg%06d", path, id)
+}
+
+// openSegments opens the sealed segments of the database, oldest first,
+// and works out the id of the next one. Segments that a completed
+// compaction superseded are removed, or skipped by read-only handles.
+// Databases opened with OpenFS have no segments.
+func (b *Bitcask) openSegments() error {
+	b.nextSeg = b.format.sealed + 1
+	if b.fsys != nil {
+		return nil
+	}
+	matches, err := filepath.Glob(b.path + ".seg*")
+	if err != nil {
+		return err
+	}
+	prefix := filepath.Base(b.path) + ".seg"
+	var ids []uint32
+	for _, m := range matches {
+		n, err := strconv.ParseUint(strings.TrimPrefix(filepath.Base(m), prefix), 10, 32)
+		if err == nil && n > 0 {
+			ids = append(ids, uint32(n))
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	active, err := b.src.Stat()
+	if err != nil {
+		return err
+	}
+	sealed := b.format.sealed
+	var segs []*segment
+	defer func() {
+		if err != nil {
+			for _, s := range segs {
+				s.file.Close()
+			}
+		}
+	}()
+	for _, id := range ids {
+		path := segmentPath(b.path, id)
+		var f *os.File
+		if f, err = os.Open(path); err != nil {
+			return err
+		}
+		s := &segment{id: id, path: path, file: f}
+		segs = append(segs, s)
+
+		var info os.FileInfo
+		if info, err = f.Stat(); err != nil {
+			return err
+		}
+		s.size = info.Size()
+		var format fileFormat
+		if format, err = readFileHeader(f, Options{ReadOnly: true}); err != nil {
+			return err
+		}
+		if format.version != b.format.version || format.tsMode != b.format.tsMode || format.checksum != b.format.checksum {
+			err = fmt.Errorf("segment %s: %w: format differs from the active file", path, ErrUnsupportedFormat)
+			return err
+		}
+		sealed = max(sealed, format.sealed)
+		// A crash while sealing can leave the segment linked to the
+		// active file too.
+		if os.SameFile(info, active) {
+			sealed = max(sealed, id)
+		}
+	}
+
+	b.segments = nil
+	for _, s := range segs {
+		if s.id > sealed {
+			b.segments = append(b.segments, s)
+			continue
+		}
+		s.file.Close()
+		if !b.opts.ReadOnly {
+			if err = os.Remove(s.path); err != nil {
+				return err
+			}
+		}
+	}
+	b.nextSeg = sealed + 1
+	if n := len(b.segments); n > 0 {
+		b.nextSeg = b.segments[n-1].id + 1
+	}
+	return nil
+}
+
+// loadSegments indexes the records of every sealed segment in order. A
+// segment ending in a torn record fails the load unless
+// Options.RepairOnLoad is set, when it is logged and indexed up to the
+// damage; if ctx is done it stops with ctx.Err(). The caller holds the
+// write lock.
+func (b *Bitcask) loadSegments(ctx context.Context) error {
+	if b.opts.LoadConcurrency > 1 && len(b.segments) > 1 {
+		return b.loadSegmentsConcurrently(ctx)
+	}
+	for _, s := range b.segments {
+		next, err := scanRecords(s.file, b.format, b.format.dataStart, s.size, func(offset int64, h recordHeader, key []byte) error {
+			b.applyRecord(s.id, offset, h, key)
+			return ctx.Err()
+		})
+		if err := b.segmentScanned(s, next, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentScanned handles the error, if any, that ended the scan of s at
+// next.
+func (b *Bitcask) segmentScanned(s *segment, next int64, err error) error {
+	if err != nil && (!damagedTail(err) || !b.opts.RepairOnLoad) {
+		return loadError(s.path, next, err)
+	}
+	if err != nil {
+		b.warnf("atomkv: %s: ignoring %d bytes from offset %d: %v", s.path, s.size-next, next, err)
+	}
+	return nil
+}
+
+// segmentIndex is the outcome of scanning one segment on its own: the last
+// record of each key in it, and how many records it holds in all.
+type segmentIndex struct {
+	latest  map[string]scannedRecord
+	records int64
+	next    int64
+	err     error
+}
+
+type scannedRecord struct {
+	offset int64
+	h      recordHeader
+}
+
+// loadSegmentsConcurrently is loadSegments with the segments scanned by up
+// to Options.LoadConcurrency goroutines. Each builds the index of one
+// segment; they are then applied oldest first, exactly as a sequential
+// load would have left the index, since a later segment's record for a key
+// always supersedes an earlier one's. The caller holds the write lock.
+func (b *Bitcask) loadSegmentsConcurrently(ctx context.Context) error {
+	indexes := make([]segmentIndex, len(b.segments))
+	sem := make(chan struct{}, b.opts.LoadConcurrency)
+	var wg sync.WaitGroup
+	for i, s := range b.segments {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			idx := &indexes[i]
+			idx.latest = make(map[string]scannedRecord)
+			idx.next, idx.err = scanRecords(s.file, b.format, b.format.dataStart, s.size, func(offset int64, h recordHeader, key []byte) error {
+				idx.latest[string(key)] = scannedRecord{offset, h}
+				idx.records++
+				return ctx.Err()
+			})
+		}()
+	}
+	wg.Wait()
+
+	for i, s := range b.segments {
+		idx := &indexes[i]
+		for key, r := range idx.latest {
+			b.applyRecord(s.id, r.offset, r.h, []byte(key))
+		}
+		// applyRecord counted the records kept; count the superseded
+		// ones too. With logical timestamps they are older than the
+		// ones kept and leave the clock alone.
+		b.records += idx.records - int64(len(idx.latest))
+		if err := b.segmentScanned(s, idx.next, idx.err); err != nil {
+			return err
+		}
+		indexes[i] = segmentIndex{}
+	}
+	return nil
+}
+
+// segmentFile returns the reader for the file holding records of segment
+// id; id 0 is the active file.
+func (b *Bitcask) segmentFile(id uint32) io.ReaderAt {
+	if id == 0 {
+		return activeFile{b}
+	}
+	i := sort.Search(len(b.segments), func(i int) bool { return b.segments[i].id >= id })
+	if i < len(b.segments) && b.segments[i].id == id {
+		return b.segments[i].file
+	}
+	return missingSegment(id)
+}
+
+// activeFile reads the active file through readAt, which also sees
+// buffered records.
+type activeFile struct{ b *Bitcask }
+
+func (a activeFile) ReadAt(p []byte, offset int64) (int, error) {
+	return a.b.readAt(p, offset)
+}
+
+// missingSegment is the reader for an index entry whose segment is gone,
+// which would be a bug.
+type missingSegment uint32
+
+func (m missingSegment) ReadAt([]byte, int64) (int, error) {
+	return 0, fmt.Errorf("%w: segment %d does not exist", ErrCorruptRecord, uint32(m))
+}
+
+// fileOrder returns a sort key placing e's record in write order: sealed
+// segments by id, then the active file.
+func (e entry) fileOrder() uint32 {
+	if e.seg == 0 {
+		return math.MaxUint32
+	}
+	return e.seg
+}
+
+// sealIfFull seals the active file if it has reached MaxSegmentSize, so
+// that the write about to happen starts a new one. If sealing fails the
+// database is left as it was. The caller holds the write lock.
+func (b *Bitcask) sealIfFull() error {
+	if b.opts.MaxSegmentSize <= 0 || b.end < b.opts.MaxSegmentSize || b.fsys != nil {
+		return nil
+	}
+	// Files in an older format are sealed once Compact upgrades them,
+	// so that all segments share the active file's format.
+	if b.format.version != formatVersion || b.end <= b.format.dataStart {
+		return nil
+	}
+
+	id := b.nextSeg
+	segPath := segmentPath(b.path, id)
+	format := b.format
+
+	tempPath := b.path + ".tmp"
+	tempFile, err := os.OpenFile(tempPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, b.opts.FileMode)
+	if err != nil {
+		return err
+	}
+	if err := writeFileHeader(tempFile, format); err == nil {
+		err = tempFile.Sync()
+	}
+	tempFile.Close()
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	if err := b.syncFile(); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err := os.Link(b.path, segPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, b.path); err != nil {
+		os.Remove(segPath)
+		os.Remove(tempPath)
+		return err
+	}
+	newFile, err := os.OpenFile(b.path, os.O_RDWR|os.O_APPEND, b.opts.FileMode)
+	if err != nil {
+		os.Rename(segPath, b.path)
+		return err
+	}
+
+	b.segments = append(b.segments, &segment{id: id, path: segPath, file: b.file, size: b.end})
+	for key, e := range b.index {
+		if e.seg == 0 {
+			e.seg = id
+			b.index[key] = e
+		}
+	}
+	b.file = newFile
+	b.src = newFile
+	b.format = format
+	b.end = format.dataStart
+	b.nextSeg++
+	b.nextGeneration()
+	return nil
+}
+
+// lastSegment returns the id of the newest sealed segment, or 0.
+func (b *Bitcask) lastSegment() uint32 {
+	if len(b.segments) == 0 {
+		return 0
+	}
+	return b.segments[len(b.segments)-1].id
+}
+
+// segmentsSize returns the total size of the sealed segments.
+func (b *Bitcask) segmentsSize() int64 {
+	var n int64
+	for _, s := range b.segments {
+		n += s.size
+	}
+	return n
+}
+
+// closeSegments closes the sealed segments and, if remove is set, deletes
+// them. The caller holds the write lock.
+func (b *Bitcask) closeSegments(remove bool) error {
+	var firstErr error
+	for _, s := range b.segments {
+		s.file.Close()
+		if remove {
+			if err := os.Remove(s.path); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	b.segments = nil
+	return firstErr
+}
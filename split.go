@@ -0,0 +1,93 @@
+package atomkv
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// SplitDB distributes the live keys of the database at srcPath over new
+// databases at destPaths, writing each key to destPaths[hash(key) %
+// len(destPaths)]. It is meant as a one-time migration from a single file
+// to sharded storage; readers must route keys with the same hash function.
+//
+// The source is opened read-only and values are copied one at a time, so
+// memory use is bounded by the source's index rather than its data.
+// Records keep their timestamps, expiry and value types. Every shard is a
+// complete database in the current format that can be opened on its own,
+// including shards that receive no keys. The destination files must not
+// exist; on error the ones SplitDB created are removed.
+//
+// Values are copied as stored: compressed ones stay compressed and
+// encrypted ones stay encrypted, so splitting an encrypted database needs
+// no EncryptionKey, and each shard is opened with the source's.
+func SplitDB(srcPath string, destPaths []string, hash func(string) uint64) (err error) {
+	if len(destPaths) == 0 {
+		return errors.New("atomkv: SplitDB needs at least one destination")
+	}
+
+	src, err := OpenWithOptions(srcPath, Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := src.Load(); err != nil {
+		return err
+	}
+
+	format := fileFormat{
+		version:   formatVersion,
+		tsMode:    src.format.tsMode,
+		checksum:  src.format.checksum,
+		dataStart: fileHeaderSize,
+	}
+
+	shards := make([]*os.File, 0, len(destPaths))
+	defer func() {
+		for i, f := range shards {
+			f.Close()
+			if err != nil {
+				os.Remove(destPaths[i])
+			}
+		}
+	}()
+	writers := make([]*bufio.Writer, len(destPaths))
+	for i, path := range destPaths {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		shards = append(shards, f)
+		if err := writeFileHeader(f, format); err != nil {
+			return err
+		}
+		writers[i] = bufio.NewWriter(f)
+	}
+
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+
+	var record []byte
+	for _, key := range src.keysByOffset() {
+		e := src.index[key]
+		value, err := src.readStored(key, e)
+		if err != nil {
+			return fmt.Errorf("read %q: %w", key, err)
+		}
+		record = format.encodeRecord(record[:0], e.timestamp, e.expiry, e.flags(), key, value, false)
+		if _, err := writers[hash(key)%uint64(len(destPaths))].Write(record); err != nil {
+			return err
+		}
+	}
+
+	for i, w := range writers {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if err := shards[i].Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package atomkv
+
+import "time"
+
+// startSyncer launches the goroutine behind Options.SyncInterval.
+func (b *Bitcask) startSyncer() {
+	b.stopSync = make(chan struct{})
+	b.syncDone = make(chan struct{})
+
+	go func() {
+		defer close(b.syncDone)
+
+		ticker := time.NewTicker(b.opts.SyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.stopSync:
+				return
+			case <-ticker.C:
+				if !b.unsynced.Load() {
+					continue
+				}
+				if err := b.Sync(); err != nil {
+					b.logf("atomkv: periodic sync failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// stopSyncing stops the periodic sync goroutine, if running, and waits for
+// it to exit. It is safe to call more than once.
+func (b *Bitcask) stopSyncing() {
+	if b.stopSync == nil {
+		return
+	}
+	b.stopSyncer.Do(func() {
+		close(b.stopSync)
+		<-b.syncDone
+	})
+}
@@ -0,0 +1,229 @@
+package atomkv
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// ErrWrongType is returned by the typed getters when the stored value has
+// a different type.
+var ErrWrongType = errors.New("value has a different type")
+
+// ErrNotInteger is returned by Increment when the stored value is not a
+// base-10 int64, or when adding the delta would overflow one.
+var ErrNotInteger = errors.New("value is not an integer")
+
+// valueType says how a record's value bytes are encoded. It is stored in
+// the low bits of the record flags; records in formats without flags hold
+// strings.
+type valueType uint8
+
+const (
+	typeString  valueType = iota
+	typeBytes             // raw bytes
+	typeInt64             // 8 bytes, little endian
+	typeFloat64           // IEEE 754 bits, 8 bytes, little endian
+	typeBool              // 1 byte, 0 or 1
+
+	typeMask = 0x07 // record flag bits holding the value type
+)
+
+// text renders a value of type t as a string, which is how Get, watch
+// events and the other string-based APIs present typed values.
+func (t valueType) text(raw []byte) string {
+	switch t {
+	case typeInt64:
+		return strconv.FormatInt(int64(binary.LittleEndian.Uint64(raw)), 10)
+	case typeFloat64:
+		return strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(raw)), 'g', -1, 64)
+	case typeBool:
+		return strconv.FormatBool(raw[0] != 0)
+	default:
+		return string(raw)
+	}
+}
+
+// decode returns a value of type t as the matching Go type.
+func (t valueType) decode(raw []byte) any {
+	switch t {
+	case typeBytes:
+		return raw
+	case typeInt64:
+		return int64(binary.LittleEndian.Uint64(raw))
+	case typeFloat64:
+		return math.Float64frombits(binary.LittleEndian.Uint64(raw))
+	case typeBool:
+		return raw[0] != 0
+	default:
+		return string(raw)
+	}
+}
+
+// SetInt stores n as a native int64 rather than as text, so it reads back
+// exactly. Get returns it in decimal.
+func (b *Bitcask) SetInt(key string, n int64) error {
+	return b.setTyped(key, binary.LittleEndian.AppendUint64(nil, uint64(n)), typeInt64)
+}
+
+// SetFloat stores f as a native float64, so it reads back bit for bit.
+// Get returns it in the shortest decimal form that round-trips.
+func (b *Bitcask) SetFloat(key string, f float64) error {
+	return b.setTyped(key, binary.LittleEndian.AppendUint64(nil, math.Float64bits(f)), typeFloat64)
+}
+
+// SetBool stores v as a native bool. Get returns "true" or "false".
+func (b *Bitcask) SetBool(key string, v bool) error {
+	raw := []byte{0}
+	if v {
+		raw[0] = 1
+	}
+	return b.setTyped(key, raw, typeBool)
+}
+
+// SetBytes stores value as raw bytes, with no string conversion. Empty
+// values and values containing any byte, NUL included, round-trip exactly.
+// GetBytes and GetValue return it as a []byte; Get returns it as a string.
+func (b *Bitcask) SetBytes(key string, value []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Formats without flags store every value as a string, which holds
+	// the same bytes.
+	vt := typeBytes
+	if !b.format.hasFlags() {
+		vt = typeString
+	}
+	return b.set(key, value, vt, 0, nil)
+}
+
+func (b *Bitcask) setTyped(key string, raw []byte, t valueType) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.format.hasFlags() {
+		return ErrUpgradeRequired
+	}
+	return b.set(key, raw, t, 0, nil)
+}
+
+// GetInt returns a value stored with SetInt. It returns ErrWrongType for
+// values of any other type, including strings that look like numbers.
+func (b *Bitcask) GetInt(key string) (int64, error) {
+	v, err := b.getTyped(key, typeInt64)
+	if err != nil {
+		return 0, err
+	}
+	return v.(int64), nil
+}
+
+// GetFloat returns a value stored with SetFloat, or ErrWrongType.
+func (b *Bitcask) GetFloat(key string) (float64, error) {
+	v, err := b.getTyped(key, typeFloat64)
+	if err != nil {
+		return 0, err
+	}
+	return v.(float64), nil
+}
+
+// GetBool returns a value stored with SetBool, or ErrWrongType.
+func (b *Bitcask) GetBool(key string) (bool, error) {
+	v, err := b.getTyped(key, typeBool)
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
+
+// Increment adds delta to the integer stored at key and returns the
+// result, treating a missing key as 0. The value may have been stored with
+// SetInt or as a base-10 string; anything else returns ErrNotInteger. The
+// read and the write happen under one lock, so concurrent increments are
+// never lost. The result is stored as with SetInt, or as a string in
+// formats without typed values.
+func (b *Bitcask) Increment(key string, delta int64) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.opts.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	var n int64
+	raw, vt, err := b.rawValue(key)
+	switch {
+	case err == ErrKeyNotFound:
+	case err != nil:
+		return 0, err
+	case vt == typeInt64:
+		n = vt.decode(raw).(int64)
+	case vt == typeString || vt == typeBytes:
+		if n, err = strconv.ParseInt(string(raw), 10, 64); err != nil {
+			return 0, ErrNotInteger
+		}
+	default:
+		return 0, ErrNotInteger
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrNotInteger
+	}
+	n += delta
+
+	if !b.format.hasFlags() {
+		err = b.set(key, []byte(strconv.FormatInt(n, 10)), typeString, 0, nil)
+	} else {
+		err = b.set(key, binary.LittleEndian.AppendUint64(nil, uint64(n)), typeInt64, 0, nil)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (b *Bitcask) getTyped(key string, t valueType) (any, error) {
+	v, vt, err := b.getValue(key)
+	if err != nil {
+		return nil, err
+	}
+	if vt != t {
+		return nil, ErrWrongType
+	}
+	return v, nil
+}
+
+// GetBytes returns key's value as raw bytes, without converting through a
+// string. It works for values stored with SetBytes or Set and returns
+// ErrWrongType for numbers and bools.
+func (b *Bitcask) GetBytes(key string) ([]byte, error) {
+	raw, vt, err := b.getRaw(key)
+	if err != nil {
+		return nil, err
+	}
+	if vt != typeBytes && vt != typeString {
+		return nil, ErrWrongType
+	}
+	return raw, nil
+}
+
+// GetValue returns key's value as the type it was stored with: string,
+// []byte, int64, float64 or bool.
+func (b *Bitcask) GetValue(key string) (any, error) {
+	v, _, err := b.getValue(key)
+	return v, err
+}
+
+func (b *Bitcask) getValue(key string) (any, valueType, error) {
+	raw, vt, err := b.getRaw(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return vt.decode(raw), vt, nil
+}
+
+// getRaw returns key's encoded value and its type.
+func (b *Bitcask) getRaw(key string) ([]byte, valueType, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	b.gets.Add(1)
+	return b.rawValue(key)
+}
@@ -0,0 +1,205 @@
+package atomkv
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ErrBackupMismatch is wrapped by the error VerifyBackup returns when the
+// backup differs from its source.
+var ErrBackupMismatch = errors.New("backup does not match source")
+
+const (
+	// maxListedMismatches caps how many keys of each kind VerifyBackup
+	// names in its error.
+	maxListedMismatches = 10
+
+	verifyScanBufferSize = 1 << 20
+)
+
+// VerifyBackup checks that the database at backupPath holds exactly the
+// live keys of the database at srcPath, with identical values. Both files
+// are opened read-only and values are compared by CRC32 checksum.
+//
+// On mismatch the returned error wraps ErrBackupMismatch and lists the keys
+// missing from the backup, the keys only in the backup, and the keys whose
+// values differ.
+func VerifyBackup(srcPath, backupPath string) error {
+	return VerifyBackupWithOptions(srcPath, backupPath, Options{})
+}
+
+// VerifyBackupWithOptions is VerifyBackup with both databases opened with
+// opts, read-only whatever opts says. Encrypted databases need their
+// EncryptionKey here, since values are compared after decryption: a backup
+// made by re-encrypting every value matches its source.
+func VerifyBackupWithOptions(srcPath, backupPath string, opts Options) error {
+	srcSums, err := checksumFile(srcPath, opts)
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	backupSums, err := checksumFile(backupPath, opts)
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+
+	var missing, extra, differ []string
+	for key, sum := range srcSums {
+		backupSum, ok := backupSums[key]
+		switch {
+		case !ok:
+			missing = append(missing, key)
+		case backupSum != sum:
+			differ = append(differ, key)
+		}
+	}
+	for key := range backupSums {
+		if _, ok := srcSums[key]; !ok {
+			extra = append(extra, key)
+		}
+	}
+
+	var problems []string
+	for _, m := range []struct {
+		what string
+		keys []string
+	}{
+		{"missing from backup", missing},
+		{"only in backup", extra},
+		{"values differ", differ},
+	} {
+		if len(m.keys) > 0 {
+			problems = append(problems, fmt.Sprintf("%s: %s", m.what, listKeys(m.keys)))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrBackupMismatch, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checksumFile opens the database at path read-only with opts and returns
+// the CRC32 of every live value.
+func checksumFile(path string, opts Options) (map[string]uint32, error) {
+	opts.ReadOnly = true
+	if opts.ScanBufferSize == 0 {
+		opts.ScanBufferSize = verifyScanBufferSize
+	}
+	db, err := OpenWithOptions(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if err := db.Load(); err != nil {
+		return nil, err
+	}
+
+	sums := make(map[string]uint32)
+	err = db.ForEach(func(key, value string) error {
+		sums[key] = crc32.ChecksumIEEE([]byte(value))
+		return nil
+	})
+	return sums, err
+}
+
+// listKeys formats keys for an error message, naming at most
+// maxListedMismatches of them.
+func listKeys(keys []string) string {
+	sort.Strings(keys)
+	if len(keys) <= maxListedMismatches {
+		return strings.Join(keys, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(keys[:maxListedMismatches], ", "), len(keys)-maxListedMismatches)
+}
+
+// readVerified is readValue for Options.VerifyReads. It also returns the
+// value's type, which comes from the log rather than the index if the two
+// disagree. The caller holds the read lock.
+func (b *Bitcask) readVerified(key string, e entry) ([]byte, valueType, error) {
+	record := make([]byte, b.format.recordSize(len(key), e.valueSize))
+	err := b.retry("read", func() error {
+		_, err := b.segmentFile(e.seg).ReadAt(record, e.offset)
+		return err
+	})
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, 0, err
+	}
+	if err == nil {
+		hdr := b.format.recordHeaderSize()
+		h := b.format.decodeHeader(record)
+		if h.keySize == uint32(len(key)) && h.valueSize == e.valueSize &&
+			string(record[hdr:hdr+int64(len(key))]) == key {
+			value, err := b.format.recordValue(record, len(key))
+			if err == nil && e.shared {
+				value, err = b.resolveShared(e.seg, value)
+			}
+			if err == nil && e.packed() {
+				value, err = b.unpack(key, value, e.flags())
+			}
+			if err == nil && e.meta {
+				value, err = stripMeta(value)
+			}
+			return value, e.vtype, err
+		}
+	}
+
+	b.logf("atomkv: index entry for %q at offset %d does not match the file; scanning the log", key, e.offset)
+	return b.scanLatest(key)
+}
+
+// scanLatest finds key's latest record by reading every record header in
+// the segments and the active file, and returns its value, or
+// ErrKeyNotFound if the key was deleted, has expired or never existed.
+func (b *Bitcask) scanLatest(key string) ([]byte, valueType, error) {
+	if err := b.flushWrites(); err != nil {
+		return nil, 0, err
+	}
+	info, err := b.src.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	found := false
+	var seg uint32
+	var offset int64
+	var latest recordHeader
+	scan := func(id uint32, src io.ReaderAt, size int64) error {
+		_, err := scanRecords(src, b.format, b.format.dataStart, size, func(off int64, h recordHeader, k []byte) error {
+			if string(k) == key {
+				found, seg, offset, latest = true, id, off, h
+			}
+			return nil
+		})
+		if err != nil && !damagedTail(err) {
+			return err
+		}
+		return nil
+	}
+	for _, s := range b.segments {
+		if err := scan(s.id, s.file, s.size); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := scan(0, b.src, info.Size()); err != nil {
+		return nil, 0, err
+	}
+	e := entry{expiry: latest.expiry}
+	if !found || latest.valueSize == tombstone || e.expired(b.now().UnixNano()) {
+		return nil, 0, ErrKeyNotFound
+	}
+
+	value, err := b.readRecordValue(seg, offset, len(key), latest.valueSize)
+	if err == nil && latest.flags&flagShared != 0 {
+		value, err = b.resolveShared(seg, value)
+	}
+	if err == nil {
+		value, err = b.unpack(key, value, latest.flags)
+	}
+	if err == nil && latest.flags&flagMeta != 0 {
+		value, err = stripMeta(value)
+	}
+	return value, valueType(latest.flags & typeMask), err
+}
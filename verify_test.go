@@ -0,0 +1,60 @@
+package atomkv
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGetIndexMismatch(t *testing.T) {
+	db, _ := openTestDB(t, Options{})
+	if err := db.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Point a at b's record, as a corrupted index offset would.
+	db.index["a"] = db.index["b"]
+	if v, err := db.Get("a"); !errors.Is(err, ErrCorruptRecord) {
+		t.Fatalf("Get(a) = %q, %v; want ErrCorruptRecord", v, err)
+	}
+	if v, err := db.Get("b"); err != nil || v != "2" {
+		t.Fatalf("Get(b) = %q, %v; want %q", v, err, "2")
+	}
+}
+
+func TestVerifyReadsFallsBackToScan(t *testing.T) {
+	db, _ := openTestDB(t, Options{VerifyReads: true})
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}, {"a", "3"}, {"c", "4"}} {
+		if err := db.Set(kv[0], kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Swapped offsets still find each key's latest value.
+	db.index["a"], db.index["b"] = db.index["b"], db.index["a"]
+	if v, err := db.Get("a"); err != nil || v != "3" {
+		t.Fatalf("Get(a) = %q, %v; want %q", v, err, "3")
+	}
+	if v, err := db.Get("b"); err != nil || v != "2" {
+		t.Fatalf("Get(b) = %q, %v; want %q", v, err, "2")
+	}
+
+	// An offset past the end of the file is a mismatch too.
+	e := db.index["a"]
+	e.offset = 1 << 20
+	db.index["a"] = e
+	if v, err := db.Get("a"); err != nil || v != "3" {
+		t.Fatalf("Get(a) with an offset past the end = %q, %v; want %q", v, err, "3")
+	}
+
+	// A key whose latest record is a tombstone is not found.
+	db.index["c"] = db.index["b"]
+	if _, err := db.Get("c"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get(c) = %v; want ErrKeyNotFound", err)
+	}
+}
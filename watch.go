@@ -0,0 +1,173 @@
+package atomkv
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Event describes a change to a key.
+type Event struct {
+	Key       string
+	Value     string // empty for deletes
+	Deleted   bool
+	Timestamp time.Time
+}
+
+// Subscription is a live watch on keys that share a prefix.
+//
+// Delivery is at-most-once. Each subscription buffers up to
+// Options.WatchBufferSize events; when an event arrives while the buffer is
+// full, the oldest buffered event is discarded to make room and counted in
+// Dropped. Writers therefore never block on a slow consumer.
+type Subscription struct {
+	// C receives events. It is closed by Close or when the database closes.
+	C <-chan Event
+
+	b       *Bitcask
+	prefix  string
+	ch      chan Event
+	dropped atomic.Uint64
+}
+
+// Subscribe starts a subscription to changes of keys starting with prefix.
+// An empty prefix matches every key.
+func (b *Bitcask) Subscribe(prefix string) *Subscription {
+	ch := make(chan Event, b.opts.WatchBufferSize)
+	s := &Subscription{C: ch, b: b, prefix: prefix, ch: ch}
+
+	b.watchMu.Lock()
+	if b.watchers == nil {
+		b.watchers = make(map[*Subscription]struct{})
+	}
+	b.watchers[s] = struct{}{}
+	b.watchMu.Unlock()
+
+	return s
+}
+
+// Dropped returns how many events were discarded because the subscriber
+// fell behind.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close unsubscribes and closes C. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.b.watchMu.Lock()
+	defer s.b.watchMu.Unlock()
+
+	if _, ok := s.b.watchers[s]; ok {
+		delete(s.b.watchers, s)
+		close(s.ch)
+	}
+}
+
+// send delivers ev, discarding the oldest buffered event if the buffer is
+// full. Callers hold watchMu, so there is never more than one sender.
+func (s *Subscription) send(ev Event) {
+	for {
+		select {
+		case s.ch <- ev:
+			return
+		default:
+		}
+
+		select {
+		case <-s.ch:
+			s.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+// Watch subscribes to every change in the database. See WatchPrefix.
+func (b *Bitcask) Watch() (<-chan Event, func()) {
+	return b.WatchPrefix("")
+}
+
+// WatchPrefix subscribes to changes of keys starting with prefix. It
+// returns the event channel and a cancel function that unsubscribes and
+// closes the channel. It is shorthand for Subscribe when the drop counter is
+// not needed; the same at-most-once delivery applies.
+func (b *Bitcask) WatchPrefix(prefix string) (<-chan Event, func()) {
+	s := b.Subscribe(prefix)
+	return s.C, s.Close
+}
+
+// publish delivers ev to every subscriber whose prefix matches its key.
+func (b *Bitcask) publish(ev Event) {
+	b.watchMu.Lock()
+	defer b.watchMu.Unlock()
+
+	for s := range b.watchers {
+		if strings.HasPrefix(ev.Key, s.prefix) {
+			s.send(ev)
+		}
+	}
+}
+
+// closeWatchers ends every subscription.
+func (b *Bitcask) closeWatchers() {
+	b.watchMu.Lock()
+	defer b.watchMu.Unlock()
+
+	for s := range b.watchers {
+		close(s.ch)
+	}
+	b.watchers = nil
+}
+
+// Changes reads the records in the data file at or after offset and calls
+// fn with each one as an Event, in file order. It returns the offset to pass
+// to the next call; start from LogSize to see only new writes.
+//
+// Unlike Watch, which only sees writes made through this handle, Changes
+// reads the file itself, so it also picks up records appended by another
+// process sharing the file. A record that is still being written is left
+// for the next call. Offsets are only valid within one Generation.
+func (b *Bitcask) Changes(offset int64, fn func(Event) error) (int64, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if err := b.flushWrites(); err != nil {
+		return offset, err
+	}
+	info, err := b.src.Stat()
+	if err != nil {
+		return offset, err
+	}
+	if offset < b.format.dataStart {
+		offset = b.format.dataStart
+	}
+	if offset >= info.Size() {
+		return offset, nil
+	}
+
+	next, err := scanRecords(b.src, b.format, offset, info.Size(), func(off int64, h recordHeader, key []byte) error {
+		ev := Event{Key: string(key), Timestamp: b.timeOf(h.timestamp)}
+		if h.valueSize == tombstone {
+			ev.Deleted = true
+		} else {
+			value, err := b.readValue(ev.Key, entry{
+				offset:     off,
+				valueSize:  h.valueSize,
+				shared:     h.flags&flagShared != 0,
+				meta:       h.flags&flagMeta != 0,
+				compressed: h.flags&flagCompressed != 0,
+				encrypted:  h.flags&flagEncrypted != 0,
+			})
+			if err != nil {
+				return err
+			}
+			ev.Value = valueType(h.flags & typeMask).text(value)
+		}
+		return fn(ev)
+	})
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	return next, err
+}
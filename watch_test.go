@@ -0,0 +1,64 @@
+package atomkv
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionSlowConsumer(t *testing.T) {
+	db, _ := openTestDB(t, Options{WatchBufferSize: 4})
+	sub := db.Subscribe("")
+
+	// The consumer takes far longer per event than the writes do, so it
+	// would hold writers up for seconds if they waited for it.
+	received := make(chan int)
+	go func() {
+		n := 0
+		for range sub.C {
+			n++
+			time.Sleep(10 * time.Millisecond)
+		}
+		received <- n
+	}()
+
+	const writes = 500
+	start := time.Now()
+	for i := 0; i < writes; i++ {
+		if err := db.Set(fmt.Sprintf("k%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > writes*10*time.Millisecond/4 {
+		t.Fatalf("writes took %v; they waited for the consumer", elapsed)
+	}
+
+	sub.Close()
+	n := <-received
+	if sub.Dropped() == 0 {
+		t.Fatal("Dropped() = 0; want events dropped for the slow consumer")
+	}
+	if got := uint64(n) + sub.Dropped(); got != writes {
+		t.Fatalf("received %d + dropped %d = %d events; want %d", n, sub.Dropped(), got, writes)
+	}
+}
+
+func TestSubscriptionDropsOldest(t *testing.T) {
+	db, _ := openTestDB(t, Options{WatchBufferSize: 4})
+	sub := db.Subscribe("")
+	defer sub.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Set("k", fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := sub.Dropped(); got != 6 {
+		t.Fatalf("Dropped() = %d; want 6", got)
+	}
+	for want := 6; want < 10; want++ {
+		if ev := <-sub.C; ev.Value != fmt.Sprint(want) {
+			t.Fatalf("event value %q; want %q", ev.Value, fmt.Sprint(want))
+		}
+	}
+}
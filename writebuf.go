@@ -0,0 +1,100 @@
+package atomkv
+
+// With Options.WriteBufferSize set, appended records collect in wbuf and
+// reach the file in one write once the buffer is full, so bursts of small
+// writes cost one syscall rather than one each. The buffered records are
+// the last len(wbuf) bytes before b.end.
+//
+// Point reads of a buffered record are served from wbuf. Everything that
+// reads the data file as a whole, fsyncs it or replaces it flushes the
+// buffer first. Flushing does not change what the database holds, only
+// where the bytes are, so it is allowed under the read lock: writers hold
+// the write lock, which keeps the buffer from growing, and wmu serialises
+// readers that flush or read it at the same time.
+
+// bufferRecord appends record, which starts at b.end, to the write
+// buffer. A record that would fill the buffer flushes it first, and one
+// that fills it on its own is written straight away; if that write fails
+// the record is dropped, so a failed write leaves no trace just as without
+// buffering. The caller holds the write lock, which also keeps readers
+// away from the buffer.
+func (b *Bitcask) bufferRecord(record []byte) error {
+	if len(b.wbuf) > 0 && len(b.wbuf)+len(record) >= b.opts.WriteBufferSize {
+		if err := b.flushWrites(); err != nil {
+			return err
+		}
+	}
+	b.wbuf = append(b.wbuf, record...)
+	b.end += int64(len(record))
+	if len(b.wbuf) >= b.opts.WriteBufferSize {
+		// The buffer was empty, so it holds only this record.
+		if err := b.flushWrites(); err != nil {
+			b.wbuf = b.wbuf[:0]
+			b.end -= int64(len(record))
+			return err
+		}
+	}
+	b.unsynced.Store(true)
+	return nil
+}
+
+// Flush writes buffered records to the data file without fsyncing it. It
+// is a no-op unless Options.WriteBufferSize is set; Sync flushes as well.
+func (b *Bitcask) Flush() error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.flushWrites()
+}
+
+// flushWrites writes the buffered records to the file. If the write fails
+// the records stay buffered, and whatever part of them reached the file is
+// truncated away before the next attempt. The caller holds the read or
+// write lock.
+func (b *Bitcask) flushWrites() error {
+	if b.opts.WriteBufferSize <= 0 {
+		return nil
+	}
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+
+	if len(b.wbuf) == 0 {
+		return nil
+	}
+	offset := b.end - int64(len(b.wbuf))
+	attempt := 0
+	err := b.retry("write", func() error {
+		if attempt++; attempt > 1 {
+			if err := b.file.Truncate(offset); err != nil {
+				return err
+			}
+		}
+		_, err := b.file.Write(b.wbuf)
+		return err
+	})
+	if err != nil {
+		b.file.Truncate(offset)
+		return err
+	}
+	b.wbuf = b.wbuf[:0]
+	return nil
+}
+
+// readBuffered serves a read of the active file from the write buffer if
+// offset lies in it. Buffered records are never split across the buffer
+// and the file, so a record read is either entirely here or entirely on
+// disk. Without Options.WriteBufferSize the buffer is always empty and
+// reads skip wmu altogether.
+func (b *Bitcask) readBuffered(p []byte, offset int64) (int, bool) {
+	if b.opts.WriteBufferSize <= 0 {
+		return 0, false
+	}
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+
+	start := b.end - int64(len(b.wbuf))
+	if len(b.wbuf) == 0 || offset < start {
+		return 0, false
+	}
+	n := copy(p, b.wbuf[offset-start:])
+	return n, true
+}
@@ -0,0 +1,50 @@
+package atomkv
+
+import (
+	"os"
+	"testing"
+)
+
+func TestBufferedReadBeforeFlush(t *testing.T) {
+	db, path := openTestDB(t, Options{WriteBufferSize: 1 << 20})
+	if err := db.Set("k", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("k", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("fresh", "1"); err != nil {
+		t.Fatal(err)
+	}
+	onDisk := func() int64 {
+		t.Helper()
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+	size := onDisk()
+	if size >= db.LogSize() {
+		t.Fatal("the writes were not buffered")
+	}
+
+	// Another goroutine sees the buffered writes, not the flushed value,
+	// and reading them does not flush the buffer.
+	type result struct{ k, fresh string }
+	got := make(chan result)
+	go func() {
+		k, _ := db.Get("k")
+		fresh, _ := db.Get("fresh")
+		got <- result{k, fresh}
+	}()
+	if r := <-got; r.k != "new" || r.fresh != "1" {
+		t.Fatalf("Get from another goroutine = %q, %q; want %q, %q", r.k, r.fresh, "new", "1")
+	}
+	if got := onDisk(); got != size {
+		t.Fatalf("reads flushed the buffer: file grew from %d to %d bytes", size, got)
+	}
+}